@@ -0,0 +1,140 @@
+package BitMapCache
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// activity queries over a shift register cache:
+// SetLastBit marks the current period, ShiftOneBit starts a new one,
+// bit 0 is the current period and bit n is n periods ago
+type Activity struct {
+	Cache
+}
+
+func NewActivity(c Cache) *Activity {
+	return &Activity{c}
+}
+
+// bits of the last n periods, current included
+func (this *Activity) lastMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+
+	if n >= this.Bits() || n >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<uint(n) - 1
+}
+
+// active in any of the last n periods
+func (this *Activity) ActiveInLast(index, n int) bool {
+	return this.GetIndex(index)&this.lastMask(n) != 0
+}
+
+// number of periods active in the whole history
+func (this *Activity) ActivePeriods(index int) int {
+	return bits.OnesCount64(this.GetIndex(index))
+}
+
+// number of periods active in a row, up to the current one
+func (this *Activity) ConsecutiveStreak(index int) int {
+	streak := bits.TrailingZeros64(^this.GetIndex(index))
+	if streak > this.Bits() {
+		return this.Bits()
+	}
+	return streak
+}
+
+// number of ids active in the last n periods
+func (this *Activity) CountActiveInLast(n int) int {
+	mask, count := this.lastMask(n), 0
+	if mask == 0 {
+		return 0
+	}
+
+	if it, ok := this.Cache.(iterable); ok {
+		for i := it.NextSet(0); i >= 0; i = it.NextSet(i + 1) {
+			if it.GetIndex(i)&mask != 0 {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i, last := 0, this.MaxIndex(); i <= last; i++ {
+		if this.GetIndex(i)&mask != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// call ShiftOneBit at every period boundary in a time zone,
+// a period of whole days starts at local midnight, shorter periods
+// are counted from local midnight, eg: hourly, every 15 minutes
+type ShiftScheduler struct {
+	cache  Cache
+	period time.Duration
+	loc    *time.Location
+	lock   sync.Locker
+	quit   chan bool
+	once   sync.Once
+}
+
+// lock guards the cache while shifting, may be nil for AtomicCache
+func NewShiftScheduler(c Cache, period time.Duration, loc *time.Location, lock sync.Locker) *ShiftScheduler {
+	if c == nil || period <= 0 {
+		return nil
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+	return &ShiftScheduler{c, period, loc, lock, make(chan bool), sync.Once{}}
+}
+
+// next period boundary after now
+func (this *ShiftScheduler) Next(now time.Time) time.Time {
+	now = now.In(this.loc)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, this.loc)
+
+	const day = 24 * time.Hour
+	if this.period%day == 0 {
+		return midnight.AddDate(0, 0, int(this.period/day))
+	}
+
+	return midnight.Add((now.Sub(midnight)/this.period + 1) * this.period)
+}
+
+func (this *ShiftScheduler) Start() {
+	go this.run()
+}
+
+func (this *ShiftScheduler) Stop() {
+	this.once.Do(func() { close(this.quit) })
+}
+
+func (this *ShiftScheduler) run() {
+	for {
+		timer := time.NewTimer(time.Until(this.Next(time.Now())))
+
+		select {
+		case <-this.quit:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+			if this.lock != nil {
+				this.lock.Lock()
+			}
+			this.cache.ShiftOneBit()
+			if this.lock != nil {
+				this.lock.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package BitMapCache
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// words per stripe lock, 32KB of flags
+const stripeWords = 4096
+
+// goroutine safe cache, bits must be 1,2,4,8,16,32 or 64
+// SetLastBit, GetIndex, ResetIndex and Count are lock free (CAS on 64-bit words),
+// ShiftOneBit and ReadFrom/WriteTo hold one stripe lock at a time
+type AtomicCache struct {
+	bits  int
+	capa  int
+	max   int64
+	count int64
+
+	slotShift uint   // log2(slots per word)
+	bitShift  uint   // log2(bits)
+	mask      uint64 // one slot
+	low       uint64 // lowest bit of every slot in a word
+
+	words   []uint64
+	stripes []sync.Mutex
+}
+
+func NewAtomicCache(nbits, capa int) *AtomicCache {
+	if !validAtomic(nbits, capa) {
+		return nil
+	}
+
+	per := 64 / nbits
+	words := make([]uint64, (capa+per-1)/per)
+	return newAtomicCache(nbits, capa, words)
+}
+
+// nbits is a power of 2 up to 64
+func validAtomic(nbits, capa int) bool {
+	return capa > 0 && nbits > 0 && nbits <= 64 && nbits&(nbits-1) == 0
+}
+
+// words must hold capa slots
+func newAtomicCache(nbits, capa int, words []uint64) *AtomicCache {
+	if nbits <= 0 || nbits > 64 || nbits&(nbits-1) != 0 {
+		return nil
+	}
+
+	this := &AtomicCache{bits: nbits, capa: capa, words: words}
+	this.bitShift = uint(bits.TrailingZeros(uint(nbits)))
+	this.slotShift = 6 - this.bitShift
+	this.mask = ^uint64(0) >> uint(64-nbits)
+	for i := 0; i < 64; i += nbits {
+		this.low |= 1 << uint(i)
+	}
+	this.stripes = make([]sync.Mutex, len(words)/stripeWords+1)
+	return this
+}
+
+func (this *AtomicCache) Bits() int {
+	return this.bits
+}
+
+func (this *AtomicCache) Capacity() int {
+	return this.capa
+}
+
+func (this *AtomicCache) Count() int {
+	return int(atomic.LoadInt64(&this.count))
+}
+
+func (this *AtomicCache) MaxIndex() int {
+	return int(atomic.LoadInt64(&this.max))
+}
+
+func (this *AtomicCache) setMaxIndex(index int) {
+	for {
+		max := atomic.LoadInt64(&this.max)
+		if int64(index) <= max || atomic.CompareAndSwapInt64(&this.max, max, int64(index)) {
+			return
+		}
+	}
+}
+
+// word index and bit offset of the slot
+func (this *AtomicCache) locate(index int) (int, uint) {
+	per := 1<<this.slotShift - 1
+	return index >> this.slotShift, uint(index&per) << this.bitShift
+}
+
+// number of slots != 0 in a word
+func (this *AtomicCache) nonZero(word uint64) int {
+	return bits.OnesCount64(this.collapse(word))
+}
+
+func (this *AtomicCache) ShiftOneBit() {
+	for s := range this.stripes {
+		this.stripes[s].Lock()
+
+		beg, end := s*stripeWords, (s+1)*stripeWords
+		if end > len(this.words) {
+			end = len(this.words)
+		}
+
+		delta := 0
+		for i := beg; i < end; i++ {
+			addr := &this.words[i]
+			for {
+				old := atomic.LoadUint64(addr)
+				now := (old << 1) &^ this.low
+				if atomic.CompareAndSwapUint64(addr, old, now) {
+					delta += this.nonZero(now) - this.nonZero(old)
+					break
+				}
+			}
+		}
+		atomic.AddInt64(&this.count, int64(delta))
+
+		this.stripes[s].Unlock()
+	}
+}
+
+func (this *AtomicCache) SetLastBit(index int) bool {
+	if index < 0 || index >= this.capa {
+		return false
+	}
+
+	this.setMaxIndex(index)
+
+	w, off := this.locate(index)
+	addr := &this.words[w]
+	for {
+		old := atomic.LoadUint64(addr)
+		slot := (old >> off) & this.mask
+		if slot&1 != 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapUint64(addr, old, old|1<<off) {
+			if slot == 0 {
+				atomic.AddInt64(&this.count, 1)
+			}
+			return true
+		}
+	}
+}
+
+func (this *AtomicCache) GetIndex(index int) uint64 {
+	if index < 0 || index >= this.capa {
+		return 0
+	}
+
+	w, off := this.locate(index)
+	return (atomic.LoadUint64(&this.words[w]) >> off) & this.mask
+}
+
+func (this *AtomicCache) ResetIndex(index int, value uint64) {
+	// a 1 bit slot is set by any value > 0, like Bit1Cache
+	if this.bits == 1 && value > 0 {
+		value = 1
+	}
+
+	value &= this.mask
+	this.update(index, func(uint64) (uint64, bool) {
+		return value, true
+	})
+}
+
+func (this *AtomicCache) lockAll() {
+	for i := range this.stripes {
+		this.stripes[i].Lock()
+	}
+}
+
+func (this *AtomicCache) unlockAll() {
+	for i := range this.stripes {
+		this.stripes[i].Unlock()
+	}
+}
+
+// recount flags and max index after the words were replaced
+func (this *AtomicCache) recount() {
+	count, max := 0, 0
+	for i := range this.words {
+		word := atomic.LoadUint64(&this.words[i])
+		if word == 0 {
+			continue
+		}
+
+		count += this.nonZero(word)
+		top := 63 - bits.LeadingZeros64(word)
+		max = i<<this.slotShift + top>>this.bitShift
+	}
+
+	atomic.StoreInt64(&this.count, int64(count))
+	atomic.StoreInt64(&this.max, int64(max))
+}
+
+func (this *AtomicCache) kind() int {
+	return kindAtomic
+}
+
+// restore count and max index loaded from a snapshot
+func (this *AtomicCache) restore(max, count int) {
+	atomic.StoreInt64(&this.max, int64(max))
+	atomic.StoreInt64(&this.count, int64(count))
+}
+
+func (this *AtomicCache) byteLen() int {
+	return 8 * len(this.words)
+}
+
+// read little endian words, count and max index are recounted
+func (this *AtomicCache) ReadFrom(r io.Reader) (int, error) {
+	this.lockAll()
+	defer this.unlockAll()
+	defer this.recount()
+
+	buf := make([]byte, 8*stripeWords)
+	for beg := 0; beg < len(this.words); beg += stripeWords {
+		words := this.words[beg:]
+		if len(words) > stripeWords {
+			words = words[:stripeWords]
+		}
+
+		if nr, err := io.ReadFull(r, buf[:8*len(words)]); err != nil {
+			return 8*beg + nr, err
+		}
+
+		for i := range words {
+			atomic.StoreUint64(&words[i], binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+	}
+
+	return 8 * len(this.words), nil
+}
+
+// write little endian words, each stripe is consistent against ShiftOneBit
+func (this *AtomicCache) WriteTo(w io.Writer) (int, error) {
+	buf, total := make([]byte, 8*stripeWords), 0
+	for s := range this.stripes {
+		beg, end := s*stripeWords, (s+1)*stripeWords
+		if end > len(this.words) {
+			end = len(this.words)
+		}
+
+		this.stripes[s].Lock()
+		for i := beg; i < end; i++ {
+			binary.LittleEndian.PutUint64(buf[8*(i-beg):], atomic.LoadUint64(&this.words[i]))
+		}
+		this.stripes[s].Unlock()
+
+		nw, err := w.Write(buf[:8*(end-beg)])
+		total += nw
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
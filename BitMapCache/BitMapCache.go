@@ -30,10 +30,10 @@ type Cache interface {
 	GetIndex(index int) uint64
 
 	//set index value
-	SetIndex(index int, value uint64)
+	ResetIndex(index int, value uint64)
 
 	ReadFrom(r io.Reader) (int, error)
-	WriterTo(w io.Writer) (int, error)
+	WriteTo(w io.Writer) (int, error)
 }
 
 type CacheCommon struct {
@@ -63,12 +63,34 @@ func (this *CacheCommon) resetCount() {
 	this.count = 0
 }
 
+// keep count right when a slot changes from old to value
+func (this *CacheCommon) changeCount(old, value uint64) {
+	if old == 0 && value != 0 {
+		this.count++
+	} else if old != 0 && value == 0 {
+		this.count--
+	}
+}
+
+func (this *CacheCommon) inRange(index int) bool {
+	return index >= 0 && index < this.capa
+}
+
 func (this *CacheCommon) setMaxIndex(index int) {
 	if index > this.max {
 		this.max = index
 	}
 }
 
+func (this *CacheCommon) kind() int {
+	return kindBitN
+}
+
+// restore count and max index loaded from a snapshot
+func (this *CacheCommon) restore(max, count int) {
+	this.max, this.count = max, count
+}
+
 func (this *CacheCommon) MaxIndex() int {
 	if this.max >= this.capa {
 		return this.capa - 1
@@ -80,22 +102,30 @@ func (this *CacheCommon) MaxIndex() int {
 //-----------------1------------------------------
 type Bit1Cache struct {
 	CacheCommon
-	set []uint8
+	set   []uint8
+	dirty *dirtyBlocks // nil until EnableTracking
 }
 
 func NewBit1Cache(capa int) *Bit1Cache {
 	set := make([]uint8, capa/8+8)
-	return &Bit1Cache{CacheCommon{1, capa, 0, 0}, set}
+	return &Bit1Cache{CacheCommon{1, capa, 0, 0}, set, nil}
 }
 
 func (this *Bit1Cache) ShiftOneBit() {
 	this.resetCount()
-	for i, _ := range this.set {
-		this.set[i] = 0
+	for i, v := range this.set {
+		if v != 0 {
+			this.set[i] = 0
+			this.touch(i, i+1)
+		}
 	}
 }
 
 func (this *Bit1Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 
 	pre, post := index>>3, index&7
@@ -104,6 +134,7 @@ func (this *Bit1Cache) SetLastBit(index int) bool {
 	if (value & flg) == 0 {
 		this.set[pre] = value | flg
 		this.addCount()
+		this.touch(pre, pre+1)
 		return true
 	}
 
@@ -111,6 +142,10 @@ func (this *Bit1Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit1Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	pre, post := index>>3, index&7
 	value, flg := this.set[pre], OpBits[post]
 
@@ -124,15 +159,26 @@ func (this *Bit1Cache) GetIndex(index int) uint64 {
 func (this *Bit1Cache) ResetIndex(index int, value uint64) {
 	if value > 0 {
 		this.SetLastBit(index)
-	} else {
+	} else if this.inRange(index) {
+		this.setMaxIndex(index)
+
 		pre, post := index>>3, index&7
 		value, flg := this.set[pre], OpBits[post]
-		this.set[pre] = value &^ flg
+		if (value & flg) != 0 {
+			this.set[pre] = value &^ flg
+			this.count--
+			this.touch(pre, pre+1)
+		}
 	}
 }
 
+func (this *Bit1Cache) byteLen() int {
+	return len(this.set)
+}
+
 func (this *Bit1Cache) ReadFrom(r io.Reader) (int, error) {
-	return r.Read(this.set)
+	this.touch(0, len(this.set))
+	return io.ReadFull(r, this.set)
 }
 
 func (this *Bit1Cache) WriteTo(w io.Writer) (int, error) {
@@ -150,12 +196,22 @@ func NewBit2Cache(capa int) *Bit2Cache {
 	return &Bit2Cache{CacheCommon{2, capa, 0, 0}, set}
 }
 
+// the baseline layout, kept so old dumps stay readable: a low bit is in bits 0-3
+// of an even byte or bits 4-7 of an odd byte, its high bit at the same bit of the next byte
+func bit2Pos(index int) (int, int) {
+	return index >> 2, index & 7
+}
+
+// every high bit takes the low bit one byte before it, low bits are cleared
 func (this *Bit2Cache) ShiftOneBit() {
-	end := this.capa/4 + 1
-	for i := 0; i < end; i += 2 {
-		this.set[i+1] = this.set[i]
-		this.set[i] = 0
+	for i := len(this.set) - 1; i > 0; i-- {
+		if i&1 == 1 {
+			this.set[i] = this.set[i-1] & 0x0F
+		} else {
+			this.set[i] = this.set[i-1] & 0xF0
+		}
 	}
+	this.set[0] = 0
 
 	this.resetCount()
 	for i, last := 0, this.MaxIndex(); i <= last; i++ {
@@ -166,12 +222,16 @@ func (this *Bit2Cache) ShiftOneBit() {
 }
 
 func (this *Bit2Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 	if this.GetIndex(index) == 0 {
 		this.addCount()
 	}
 
-	pre, post := index>>2, index&7
+	pre, post := bit2Pos(index)
 	value, flg := this.set[pre], OpBits[post]
 
 	if (value & flg) == 0 {
@@ -183,20 +243,26 @@ func (this *Bit2Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit2Cache) GetIndex(index int) uint64 {
-	pre, post := index>>2, index&7
+	if !this.inRange(index) {
+		return 0
+	}
+
+	pre, post := bit2Pos(index)
 	value0, value1, flg := this.set[pre], this.set[pre+1], OpBits[post]
 	bit0, bit1 := (value0&flg)/flg, (value1&flg)/flg
 	return uint64(bit0 + (bit1 << 1))
 }
 
 func (this *Bit2Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.GetIndex(index) == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	value &= 3
+	this.changeCount(this.GetIndex(index), value)
 	this.setMaxIndex(index)
 
-	pre, post := index>>2, index&7
+	pre, post := bit2Pos(index)
 	value0, value1, flg := this.set[pre], this.set[pre+1], OpBits[post]
 
 	switch value {
@@ -218,8 +284,12 @@ func (this *Bit2Cache) ResetIndex(index int, value uint64) {
 	}
 }
 
+func (this *Bit2Cache) byteLen() int {
+	return len(this.set)
+}
+
 func (this *Bit2Cache) ReadFrom(r io.Reader) (int, error) {
-	return r.Read(this.set)
+	return io.ReadFull(r, this.set)
 }
 
 func (this *Bit2Cache) WriteTo(w io.Writer) (int, error) {
@@ -251,6 +321,10 @@ func (this *Bit4Cache) ShiftOneBit() {
 }
 
 func (this *Bit4Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 
 	idx, lastbit := index>>1, index&1
@@ -278,6 +352,10 @@ func (this *Bit4Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit4Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	idx, lastbit := index>>1, index&1
 
 	if lastbit == 0 {
@@ -288,23 +366,29 @@ func (this *Bit4Cache) GetIndex(index int) uint64 {
 }
 
 func (this *Bit4Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.GetIndex(index) == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	value &= 0xF
+	this.changeCount(this.GetIndex(index), value)
 	this.setMaxIndex(index)
 
 	idx, lastbit := index>>1, index&1
 
 	if lastbit == 0 {
-		this.set[idx] = (this.set[idx] & 0xF0) | uint8(value&0xF)
+		this.set[idx] = (this.set[idx] & 0xF0) | uint8(value)
+	} else {
+		this.set[idx] = uint8(value<<4) | (this.set[idx] & 0xF)
 	}
+}
 
-	this.set[idx] = uint8(value<<4) | (this.set[idx] & 0xF)
+func (this *Bit4Cache) byteLen() int {
+	return len(this.set)
 }
 
 func (this *Bit4Cache) ReadFrom(r io.Reader) (int, error) {
-	return r.Read(this.set)
+	return io.ReadFull(r, this.set)
 }
 
 func (this *Bit4Cache) WriteTo(w io.Writer) (int, error) {
@@ -332,7 +416,7 @@ func (this *Bit8Cache) ShiftOneBit() {
 }
 
 func (this *Bit8Cache) SetLastBit(index int) bool {
-	if index >= this.capa {
+	if !this.inRange(index) {
 		return false
 	}
 
@@ -351,20 +435,29 @@ func (this *Bit8Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit8Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	return uint64(this.set[index])
 }
 
 func (this *Bit8Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.set[index] == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	this.changeCount(uint64(this.set[index]), uint64(uint8(value)))
 	this.setMaxIndex(index)
 	this.set[index] = uint8(value)
 }
 
+func (this *Bit8Cache) byteLen() int {
+	return len(this.set)
+}
+
 func (this *Bit8Cache) ReadFrom(r io.Reader) (int, error) {
-	return r.Read(this.set)
+	return io.ReadFull(r, this.set)
 }
 
 func (this *Bit8Cache) WriteTo(w io.Writer) (int, error) {
@@ -392,6 +485,10 @@ func (this *Bit16Cache) ShiftOneBit() {
 }
 
 func (this *Bit16Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 
 	if this.set[index] == 0 {
@@ -407,39 +504,33 @@ func (this *Bit16Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit16Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	return uint64(this.set[index])
 }
 
 func (this *Bit16Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.set[index] == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	this.changeCount(uint64(this.set[index]), uint64(uint16(value)))
 	this.setMaxIndex(index)
 	this.set[index] = uint16(value)
 }
 
+func (this *Bit16Cache) byteLen() int {
+	return 2 * len(this.set)
+}
+
 func (this *Bit16Cache) ReadFrom(r io.Reader) (int, error) {
-	index, buf := 0, make([]byte, 2)
-	for index < len(this.set) {
-		if nr, err := r.Read(buf); nr != 2 || err != nil {
-			break
-		}
-		this.set[index] = binary.LittleEndian.Uint16(buf)
-		index += 1
-	}
-	return index, nil
+	return readUint16s(r, this.set)
 }
 
 func (this *Bit16Cache) WriteTo(w io.Writer) (int, error) {
-	buf := make([]byte, 2)
-	for i, v := range this.set {
-		binary.LittleEndian.PutUint16(buf, v)
-		if nr, err := w.Write(buf); nr != 2 || err != nil {
-			return i, nil
-		}
-	}
-	return 0, nil
+	return writeUint16s(w, this.set)
 }
 
 // -----------------------------32------------------------
@@ -463,6 +554,10 @@ func (this *Bit32Cache) ShiftOneBit() {
 }
 
 func (this *Bit32Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 
 	if this.set[index] == 0 {
@@ -478,39 +573,33 @@ func (this *Bit32Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit32Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	return uint64(this.set[index])
 }
 
 func (this *Bit32Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.set[index] == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	this.changeCount(uint64(this.set[index]), uint64(uint32(value)))
 	this.setMaxIndex(index)
 	this.set[index] = uint32(value)
 }
 
+func (this *Bit32Cache) byteLen() int {
+	return 4 * len(this.set)
+}
+
 func (this *Bit32Cache) ReadFrom(r io.Reader) (int, error) {
-	index, buf := 0, make([]byte, 4)
-	for index < len(this.set) {
-		if nr, err := r.Read(buf); nr != 4 || err != nil {
-			break
-		}
-		this.set[index] = binary.LittleEndian.Uint32(buf)
-		index += 1
-	}
-	return index, nil
+	return readUint32s(r, this.set)
 }
 
 func (this *Bit32Cache) WriteTo(w io.Writer) (int, error) {
-	buf := make([]byte, 4)
-	for i, v := range this.set {
-		binary.LittleEndian.PutUint32(buf, v)
-		if nr, err := w.Write(buf); nr != 4 || err != nil {
-			return i, nil
-		}
-	}
-	return 0, nil
+	return writeUint32s(w, this.set)
 }
 
 // ---------------------------64----------------------------
@@ -534,6 +623,10 @@ func (this *Bit64Cache) ShiftOneBit() {
 }
 
 func (this *Bit64Cache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
 	this.setMaxIndex(index)
 
 	if this.set[index] == 0 {
@@ -549,37 +642,166 @@ func (this *Bit64Cache) SetLastBit(index int) bool {
 }
 
 func (this *Bit64Cache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
 	return this.set[index]
 }
 
 func (this *Bit64Cache) ResetIndex(index int, value uint64) {
-	if value > 0 && this.set[index] == 0 {
-		this.addCount()
+	if !this.inRange(index) {
+		return
 	}
 
+	this.changeCount(this.set[index], value)
 	this.setMaxIndex(index)
 	this.set[index] = value
 }
 
+func (this *Bit64Cache) byteLen() int {
+	return 8 * len(this.set)
+}
+
 func (this *Bit64Cache) ReadFrom(r io.Reader) (int, error) {
-	index, buf := 0, make([]byte, 8)
-	for index < len(this.set) {
-		if nr, err := r.Read(buf); nr != 8 || err != nil {
-			break
+	return readUint64s(r, this.set)
+}
+
+func (this *Bit64Cache) WriteTo(w io.Writer) (int, error) {
+	return writeUint64s(w, this.set)
+}
+
+// ---------------------------little endian io----------------------------
+const ioChunk = 32 * 1024
+
+func readUint16s(r io.Reader, set []uint16) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/2 {
+			n = ioChunk / 2
 		}
-		this.set[index] = binary.LittleEndian.Uint64(buf)
-		index += 1
+
+		nr, err := io.ReadFull(r, buf[:2*n])
+		total += nr
+		if err != nil {
+			return total, err
+		}
+
+		for i := 0; i < n; i++ {
+			set[i] = binary.LittleEndian.Uint16(buf[2*i:])
+		}
+		set = set[n:]
 	}
-	return index, nil
+	return total, nil
 }
 
-func (this *Bit64Cache) WriteTo(w io.Writer) (int, error) {
-	buf := make([]byte, 8)
-	for i, v := range this.set {
-		binary.LittleEndian.PutUint64(buf, v)
-		if nr, err := w.Write(buf); nr != 8 || err != nil {
-			return i, nil
+func writeUint16s(w io.Writer, set []uint16) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/2 {
+			n = ioChunk / 2
+		}
+
+		for i := 0; i < n; i++ {
+			binary.LittleEndian.PutUint16(buf[2*i:], set[i])
+		}
+
+		nw, err := w.Write(buf[:2*n])
+		total += nw
+		if err != nil {
+			return total, err
+		}
+		set = set[n:]
+	}
+	return total, nil
+}
+
+func readUint32s(r io.Reader, set []uint32) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/4 {
+			n = ioChunk / 4
+		}
+
+		nr, err := io.ReadFull(r, buf[:4*n])
+		total += nr
+		if err != nil {
+			return total, err
+		}
+
+		for i := 0; i < n; i++ {
+			set[i] = binary.LittleEndian.Uint32(buf[4*i:])
+		}
+		set = set[n:]
+	}
+	return total, nil
+}
+
+func writeUint32s(w io.Writer, set []uint32) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/4 {
+			n = ioChunk / 4
+		}
+
+		for i := 0; i < n; i++ {
+			binary.LittleEndian.PutUint32(buf[4*i:], set[i])
+		}
+
+		nw, err := w.Write(buf[:4*n])
+		total += nw
+		if err != nil {
+			return total, err
+		}
+		set = set[n:]
+	}
+	return total, nil
+}
+
+func readUint64s(r io.Reader, set []uint64) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/8 {
+			n = ioChunk / 8
+		}
+
+		nr, err := io.ReadFull(r, buf[:8*n])
+		total += nr
+		if err != nil {
+			return total, err
+		}
+
+		for i := 0; i < n; i++ {
+			set[i] = binary.LittleEndian.Uint64(buf[8*i:])
+		}
+		set = set[n:]
+	}
+	return total, nil
+}
+
+func writeUint64s(w io.Writer, set []uint64) (int, error) {
+	buf, total := make([]byte, ioChunk), 0
+	for len(set) > 0 {
+		n := len(set)
+		if n > ioChunk/8 {
+			n = ioChunk / 8
+		}
+
+		for i := 0; i < n; i++ {
+			binary.LittleEndian.PutUint64(buf[8*i:], set[i])
+		}
+
+		nw, err := w.Write(buf[:8*n])
+		total += nw
+		if err != nil {
+			return total, err
 		}
+		set = set[n:]
 	}
-	return 0, nil
+	return total, nil
 }
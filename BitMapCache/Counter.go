@@ -0,0 +1,204 @@
+package BitMapCache
+
+import (
+	"sync/atomic"
+)
+
+// caches used as per-id counters, eg: login attempts, rate limits, frequency tables.
+// Incr and Decr saturate at the width's max value and at 0, the bool is false
+// when the value saturated or the index is out of range.
+// Halve divides every slot by 2 to decay old counts.
+type Counter interface {
+	Cache
+	Incr(index int, delta uint64) (uint64, bool)
+	Decr(index int, delta uint64) (uint64, bool)
+	Halve()
+}
+
+func addSaturate(value, delta, max uint64) (uint64, bool) {
+	if delta > max-value {
+		return max, false
+	}
+	return value + delta, true
+}
+
+func subSaturate(value, delta uint64) (uint64, bool) {
+	if delta > value {
+		return 0, false
+	}
+	return value - delta, true
+}
+
+// Incr on a cache which isn't goroutine safe
+func incr(c Cache, index int, delta, max uint64) (uint64, bool) {
+	if index < 0 || index >= c.Capacity() {
+		return 0, false
+	}
+
+	value, ok := addSaturate(c.GetIndex(index), delta, max)
+	c.ResetIndex(index, value)
+	return value, ok
+}
+
+func decr(c Cache, index int, delta uint64) (uint64, bool) {
+	if index < 0 || index >= c.Capacity() {
+		return 0, false
+	}
+
+	value, ok := subSaturate(c.GetIndex(index), delta)
+	c.ResetIndex(index, value)
+	return value, ok
+}
+
+// ---------------------------4--------------------------------
+func (this *Bit4Cache) Incr(index int, delta uint64) (uint64, bool) {
+	return incr(this, index, delta, 0xF)
+}
+
+func (this *Bit4Cache) Decr(index int, delta uint64) (uint64, bool) {
+	return decr(this, index, delta)
+}
+
+func (this *Bit4Cache) Halve() {
+	this.resetCount()
+	for i, flags := range this.set {
+		flags = (flags >> 1) & 0x77
+		if flags&0x7 != 0 {
+			this.addCount()
+		}
+		if flags&0x70 != 0 {
+			this.addCount()
+		}
+		this.set[i] = flags
+	}
+}
+
+// ---------------------------8--------------------------------
+func (this *Bit8Cache) Incr(index int, delta uint64) (uint64, bool) {
+	return incr(this, index, delta, 0xFF)
+}
+
+func (this *Bit8Cache) Decr(index int, delta uint64) (uint64, bool) {
+	return decr(this, index, delta)
+}
+
+func (this *Bit8Cache) Halve() {
+	this.resetCount()
+	for i, v := range this.set {
+		this.set[i] = v >> 1
+		if this.set[i] > 0 {
+			this.addCount()
+		}
+	}
+}
+
+// ---------------------------16-------------------------------
+func (this *Bit16Cache) Incr(index int, delta uint64) (uint64, bool) {
+	return incr(this, index, delta, 0xFFFF)
+}
+
+func (this *Bit16Cache) Decr(index int, delta uint64) (uint64, bool) {
+	return decr(this, index, delta)
+}
+
+func (this *Bit16Cache) Halve() {
+	this.resetCount()
+	for i, v := range this.set {
+		this.set[i] = v >> 1
+		if this.set[i] > 0 {
+			this.addCount()
+		}
+	}
+}
+
+// ---------------------------N--------------------------------
+func (this *HistoryCache) Incr(index int, delta uint64) (uint64, bool) {
+	return incr(this, index, delta, this.mask)
+}
+
+func (this *HistoryCache) Decr(index int, delta uint64) (uint64, bool) {
+	return decr(this, index, delta)
+}
+
+func (this *HistoryCache) Halve() {
+	period := len(this.lows)
+	for i := range this.words {
+		// the highest bit of every slot, the one below a lowest bit
+		highs := this.lows[i%period]>>1 | this.lows[(i+1)%period]<<63
+
+		carry := uint64(0)
+		if i+1 < len(this.words) {
+			carry = this.words[i+1] << 63
+		}
+		this.words[i] = (this.words[i]>>1 | carry) &^ highs
+	}
+
+	this.recount()
+}
+
+// ---------------------------atomic---------------------------
+func (this *AtomicCache) Incr(index int, delta uint64) (uint64, bool) {
+	return this.update(index, func(value uint64) (uint64, bool) {
+		return addSaturate(value, delta, this.mask)
+	})
+}
+
+func (this *AtomicCache) Decr(index int, delta uint64) (uint64, bool) {
+	return this.update(index, func(value uint64) (uint64, bool) {
+		return subSaturate(value, delta)
+	})
+}
+
+// CAS a slot to fn(slot)
+func (this *AtomicCache) update(index int, fn func(value uint64) (uint64, bool)) (uint64, bool) {
+	if index < 0 || index >= this.capa {
+		return 0, false
+	}
+
+	this.setMaxIndex(index)
+
+	w, off := this.locate(index)
+	addr := &this.words[w]
+	for {
+		old := atomic.LoadUint64(addr)
+		slot := (old >> off) & this.mask
+		value, ok := fn(slot)
+		if atomic.CompareAndSwapUint64(addr, old, old&^(this.mask<<off)|value<<off) {
+			if slot == 0 && value != 0 {
+				atomic.AddInt64(&this.count, 1)
+			} else if slot != 0 && value == 0 {
+				atomic.AddInt64(&this.count, -1)
+			}
+			return value, ok
+		}
+	}
+}
+
+// holds one stripe lock at a time like ShiftOneBit
+func (this *AtomicCache) Halve() {
+	highs := this.low << uint(this.bits-1)
+	for s := range this.stripes {
+		this.stripes[s].Lock()
+
+		beg, end := s*stripeWords, (s+1)*stripeWords
+		if end > len(this.words) {
+			end = len(this.words)
+		}
+
+		delta := 0
+		for i := beg; i < end; i++ {
+			addr := &this.words[i]
+			for {
+				old := atomic.LoadUint64(addr)
+				now := (old >> 1) &^ highs
+				if atomic.CompareAndSwapUint64(addr, old, now) {
+					delta += this.nonZero(now) - this.nonZero(old)
+					break
+				}
+			}
+		}
+		atomic.AddInt64(&this.count, int64(delta))
+
+		this.stripes[s].Unlock()
+	}
+}
@@ -0,0 +1,254 @@
+package BitMapCache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+/*
+delta sync of Bit1Cache between a leader and its followers:
+
+	leader.EnableTracking()
+	delta := leader.Diff(follower.Version())   // under the leader's lock
+	delta.WriteTo(conn)
+	...
+	delta, err := ReadDelta(conn)
+	follower.ApplyDelta(delta)                  // under the follower's lock
+
+every change stamps its 4KB block with a new version, a delta carries the
+blocks changed after a version. tracking starts at the current unix time
+in nanoseconds with every block stamped, so a follower of a restarted
+leader gets all blocks in its next delta.
+
+delta layout, all fields little endian:
+
+	0  magic   uint32 "BDLT"
+	4  blocks  uint32
+	8  since   uint64
+	16 version uint64
+	24 capa    uint64
+	32 max     uint64
+	40 count   uint64
+	48 blocks * (block uint32, length uint32, data)
+	.. crc     uint32 crc32(IEEE) of all bytes before
+*/
+
+const (
+	DeltaBlockSize = 4096
+
+	deltaMagic   = 0x544c4442
+	deltaHeadLen = 48
+)
+
+var (
+	ErrDeltaFormat   = errors.New("bad delta")
+	ErrDeltaChecksum = errors.New("delta checksum mismatch")
+	ErrDeltaVersion  = errors.New("delta is newer than the cache, a full sync is needed")
+)
+
+// version of the last change of every block
+type dirtyBlocks struct {
+	version uint64
+	blocks  []uint64
+}
+
+func newDirtyBlocks(size int, version uint64) *dirtyBlocks {
+	blocks := make([]uint64, (size+DeltaBlockSize-1)/DeltaBlockSize)
+	for i := range blocks {
+		blocks[i] = version
+	}
+	return &dirtyBlocks{version, blocks}
+}
+
+// stamp the blocks of bytes [from, to) with a new version
+func (this *dirtyBlocks) mark(from, to int) {
+	this.version++
+	for b, last := from/DeltaBlockSize, (to-1)/DeltaBlockSize; b <= last && b < len(this.blocks); b++ {
+		this.blocks[b] = this.version
+	}
+}
+
+// blocks changed by a leader after version Since
+type Delta struct {
+	Since    uint64
+	Version  uint64
+	Capacity int
+	MaxIndex int
+	Count    int
+	Blocks   []int
+	Data     [][]byte
+}
+
+func (this *Bit1Cache) touch(from, to int) {
+	if this.dirty != nil {
+		this.dirty.mark(from, to)
+	}
+}
+
+// start tracking changed blocks, a cache that is not tracked has version 0
+func (this *Bit1Cache) EnableTracking() {
+	if this.dirty == nil {
+		this.dirty = newDirtyBlocks(len(this.set), uint64(time.Now().UnixNano()))
+	}
+}
+
+func (this *Bit1Cache) Version() uint64 {
+	if this.dirty == nil {
+		return 0
+	}
+	return this.dirty.version
+}
+
+// copy of the blocks changed after since, nil if the cache is not tracked
+func (this *Bit1Cache) Diff(since uint64) *Delta {
+	if this.dirty == nil {
+		return nil
+	}
+
+	delta := &Delta{since, this.dirty.version, this.capa, this.max, this.count, nil, nil}
+	for b, version := range this.dirty.blocks {
+		if version > since {
+			from := b * DeltaBlockSize
+			to := from + DeltaBlockSize
+			if to > len(this.set) {
+				to = len(this.set)
+			}
+
+			delta.Blocks = append(delta.Blocks, b)
+			delta.Data = append(delta.Data, append([]byte(nil), this.set[from:to]...))
+		}
+	}
+	return delta
+}
+
+// copy the blocks of a leader's delta, the cache takes the leader's version
+// and can serve deltas to its own followers
+func (this *Bit1Cache) ApplyDelta(delta *Delta) error {
+	if delta.Capacity != this.capa {
+		return ErrCapacityMismatch
+	}
+
+	if delta.Since > this.Version() {
+		return ErrDeltaVersion
+	}
+
+	if len(delta.Blocks) != len(delta.Data) {
+		return ErrDeltaFormat
+	}
+
+	// check every block before changing anything
+	for i, b := range delta.Blocks {
+		if b < 0 || b*DeltaBlockSize >= len(this.set) {
+			return ErrDeltaFormat
+		}
+
+		size := len(this.set) - b*DeltaBlockSize
+		if size > DeltaBlockSize {
+			size = DeltaBlockSize
+		}
+
+		if len(delta.Data[i]) != size {
+			return ErrDeltaFormat
+		}
+	}
+
+	if this.dirty == nil {
+		this.dirty = newDirtyBlocks(len(this.set), 0)
+	}
+
+	for i, b := range delta.Blocks {
+		copy(this.set[b*DeltaBlockSize:], delta.Data[i])
+		this.dirty.blocks[b] = delta.Version
+	}
+
+	this.dirty.version = delta.Version
+	this.restore(delta.MaxIndex, delta.Count)
+	return nil
+}
+
+// io.WriterTo, unlike the caches which keep the int of Cache
+func (this *Delta) WriteTo(w io.Writer) (int64, error) {
+	size := deltaHeadLen + 4
+	for _, data := range this.Data {
+		size += 8 + len(data)
+	}
+
+	buf := make([]byte, deltaHeadLen, size)
+	le := binary.LittleEndian
+	le.PutUint32(buf[0:], deltaMagic)
+	le.PutUint32(buf[4:], uint32(len(this.Blocks)))
+	le.PutUint64(buf[8:], this.Since)
+	le.PutUint64(buf[16:], this.Version)
+	le.PutUint64(buf[24:], uint64(this.Capacity))
+	le.PutUint64(buf[32:], uint64(this.MaxIndex))
+	le.PutUint64(buf[40:], uint64(this.Count))
+
+	for i, b := range this.Blocks {
+		buf = le.AppendUint32(buf, uint32(b))
+		buf = le.AppendUint32(buf, uint32(len(this.Data[i])))
+		buf = append(buf, this.Data[i]...)
+	}
+
+	buf = le.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	nw, err := w.Write(buf)
+	return int64(nw), err
+}
+
+func ReadDelta(r io.Reader) (*Delta, error) {
+	head := make([]byte, deltaHeadLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	if le.Uint32(head) != deltaMagic {
+		return nil, ErrDeltaFormat
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(head)
+
+	delta := &Delta{le.Uint64(head[8:]), le.Uint64(head[16:]),
+		int(le.Uint64(head[24:])), int(le.Uint64(head[32:])), int(le.Uint64(head[40:])), nil, nil}
+
+	// a Bit1Cache of this capacity has at most this many blocks
+	n := int(le.Uint32(head[4:]))
+	if delta.Capacity <= 0 || n > (delta.Capacity/8+8)/DeltaBlockSize+1 {
+		return nil, ErrDeltaFormat
+	}
+
+	blockHead := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(r, blockHead); err != nil {
+			return nil, err
+		}
+
+		size := le.Uint32(blockHead[4:])
+		if size > DeltaBlockSize {
+			return nil, ErrDeltaFormat
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		crc.Write(blockHead)
+		crc.Write(data)
+		delta.Blocks = append(delta.Blocks, int(le.Uint32(blockHead)))
+		delta.Data = append(delta.Data, data)
+	}
+
+	tail := make([]byte, 4)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		return nil, err
+	}
+
+	if le.Uint32(tail) != crc.Sum32() {
+		return nil, ErrDeltaChecksum
+	}
+	return delta, nil
+}
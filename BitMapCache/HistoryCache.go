@@ -0,0 +1,254 @@
+package BitMapCache
+
+import (
+	"io"
+	"math/bits"
+)
+
+// cache of any width from 1 to 64 bits (3, 5, 12 ...), slots are packed in 64-bit words
+// and may cross a word boundary; it behaves like Bit1Cache..Bit64Cache for their widths
+type HistoryCache struct {
+	CacheCommon
+	mask  uint64
+	lows  []uint64 // lowest bit of every slot, repeats every len(lows) words
+	words []uint64
+}
+
+func NewHistoryCache(nbits, capa int) *HistoryCache {
+	if nbits <= 0 || nbits > 64 || capa <= 0 {
+		return nil
+	}
+
+	// the slot pattern repeats every nbits/gcd(nbits, 64) words
+	gcd := 64
+	for a := nbits; a != 0; gcd, a = a, gcd%a {
+	}
+	period := nbits / gcd
+
+	lows := make([]uint64, period)
+	for bit := 0; bit < period*64; bit += nbits {
+		lows[bit>>6] |= 1 << uint(bit&63)
+	}
+
+	// one more word, the last slot may cross into it
+	words := make([]uint64, (capa*nbits+63)/64+1)
+	return &HistoryCache{CacheCommon{nbits, capa, 0, 0}, ^uint64(0) >> uint(64-nbits), lows, words}
+}
+
+func (this *HistoryCache) get(index int) uint64 {
+	bit := index * this.bits
+	w, off := bit>>6, uint(bit&63)
+	value := this.words[w] >> off
+	if off+uint(this.bits) > 64 {
+		value |= this.words[w+1] << (64 - off)
+	}
+	return value & this.mask
+}
+
+func (this *HistoryCache) put(index int, value uint64) {
+	bit := index * this.bits
+	w, off := bit>>6, uint(bit&63)
+	this.words[w] = this.words[w]&^(this.mask<<off) | value<<off
+	if off+uint(this.bits) > 64 {
+		rest := 64 - off
+		this.words[w+1] = this.words[w+1]&^(this.mask>>rest) | value>>rest
+	}
+}
+
+func (this *HistoryCache) ShiftOneBit() {
+	period := len(this.lows)
+	for i := len(this.words) - 1; i >= 0; i-- {
+		carry := uint64(0)
+		if i > 0 {
+			carry = this.words[i-1] >> 63
+		}
+		this.words[i] = (this.words[i]<<1 | carry) &^ this.lows[i%period]
+	}
+
+	this.recount()
+}
+
+func (this *HistoryCache) SetLastBit(index int) bool {
+	if !this.inRange(index) {
+		return false
+	}
+
+	this.setMaxIndex(index)
+
+	value := this.get(index)
+	if value&1 != 0 {
+		return false
+	}
+
+	if value == 0 {
+		this.addCount()
+	}
+	this.put(index, value|1)
+	return true
+}
+
+func (this *HistoryCache) GetIndex(index int) uint64 {
+	if !this.inRange(index) {
+		return 0
+	}
+
+	return this.get(index)
+}
+
+func (this *HistoryCache) ResetIndex(index int, value uint64) {
+	if !this.inRange(index) {
+		return
+	}
+
+	// a 1 bit slot is set by any value > 0, like Bit1Cache
+	if this.bits == 1 && value > 0 {
+		value = 1
+	}
+
+	value &= this.mask
+	this.changeCount(this.get(index), value)
+	this.setMaxIndex(index)
+	this.put(index, value)
+}
+
+func (this *HistoryCache) recount() {
+	this.resetCount()
+	for i := this.NextSet(0); i >= 0; i = this.NextSet(i + 1) {
+		this.addCount()
+	}
+}
+
+func (this *HistoryCache) kind() int {
+	return kindHistory
+}
+
+func (this *HistoryCache) byteLen() int {
+	return 8 * len(this.words)
+}
+
+// read little endian words, count and max index are recounted
+func (this *HistoryCache) ReadFrom(r io.Reader) (int, error) {
+	nr, err := readUint64s(r, this.words)
+	if err != nil {
+		return nr, err
+	}
+
+	this.recount()
+	this.max = 0
+	for i := len(this.words) - 1; i >= 0; i-- {
+		if word := this.words[i]; word != 0 {
+			this.max = (i<<6 + 63 - bits.LeadingZeros64(word)) / this.bits
+			break
+		}
+	}
+	return nr, nil
+}
+
+// write little endian words
+func (this *HistoryCache) WriteTo(w io.Writer) (int, error) {
+	return writeUint64s(w, this.words)
+}
+
+func (this *HistoryCache) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	if from >= this.capa {
+		return -1
+	}
+
+	bit := from * this.bits
+	w := bit >> 6
+	word := this.words[w] & (^uint64(0) << uint(bit&63))
+	for {
+		if word != 0 {
+			if index := (w<<6 + bits.TrailingZeros64(word)) / this.bits; index < this.capa {
+				return index
+			}
+			return -1
+		}
+
+		if w++; w >= len(this.words) {
+			return -1
+		}
+		word = this.words[w]
+	}
+}
+
+func (this *HistoryCache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+// a block is a word, a slot is counted in the word it starts in: the bits of
+// every slot are or'ed into its lowest bit, reaching into the next word
+func (this *HistoryCache) blocks() *blockSlots {
+	nbits, period := this.bits, len(this.lows)
+	presence := func(b int) uint64 {
+		lo, hi := this.words[b], uint64(0)
+		if b+1 < len(this.words) {
+			hi = this.words[b+1]
+		}
+
+		// or nbits bits: spans double up to nbits, then one overlapping shift
+		span := 1
+		for ; span*2 <= nbits; span *= 2 {
+			lo, hi = lo|lo>>uint(span)|hi<<uint(64-span), hi|hi>>uint(span)
+		}
+		if rest := uint(nbits - span); rest > 0 {
+			lo |= lo>>rest | hi<<(64-rest)
+		}
+		return lo & this.lows[b%period]
+	}
+
+	return &blockSlots{this.capa, len(this.words), presence,
+		func(index int) (int, int) { return index * nbits >> 6, index * nbits & 63 },
+		func(b, bit int) int { return (b<<6 + bit) / nbits }}
+}
+
+func (this *HistoryCache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *HistoryCache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+func (this *HistoryCache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	for i := from; i < to; i++ {
+		this.ResetIndex(i, value)
+	}
+}
+
+func (this *HistoryCache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+func (this *HistoryCache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for i := this.NextSet(from); i >= 0 && i < to; i = this.NextSet(i + 1) {
+		count++
+	}
+	return count
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *HistoryCache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
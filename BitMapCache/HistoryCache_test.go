@@ -0,0 +1,182 @@
+package BitMapCache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+type testCache interface {
+	Cache
+	NextSet(from int) int
+	Rank(index int) int
+	Select(n int) int
+}
+
+// every cache of a width, the hand-written ones agree with HistoryCache
+func cachesOf(nbits, capa int) map[string]testCache {
+	res := map[string]testCache{"HistoryCache": NewHistoryCache(nbits, capa)}
+	switch nbits {
+	case 1:
+		res["Bit1Cache"] = NewBit1Cache(capa)
+		res["SparseCache"] = NewSparseCache(capa)
+	case 2:
+		res["Bit2Cache"] = NewBit2Cache(capa)
+	case 4:
+		res["Bit4Cache"] = NewBit4Cache(capa)
+	case 8:
+		res["Bit8Cache"] = NewBit8Cache(capa)
+	case 16:
+		res["Bit16Cache"] = NewBit16Cache(capa)
+	case 32:
+		res["Bit32Cache"] = NewBit32Cache(capa)
+	case 64:
+		res["Bit64Cache"] = NewBit64Cache(capa)
+	}
+
+	if c := NewAtomicCache(nbits, capa); c != nil {
+		res["AtomicCache"] = c
+	}
+	return res
+}
+
+// naive reference: one uint64 per slot
+type model struct {
+	mask  uint64
+	slots []uint64
+	max   int
+}
+
+func (this *model) count() int {
+	count := 0
+	for _, v := range this.slots {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *model) nextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	for i := from; i < len(this.slots); i++ {
+		if this.slots[i] != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rank and Select of every index only when full, they are slow to check
+func checkCache(t *testing.T, name string, step int, c testCache, m *model, full bool) {
+	if c.Count() != m.count() {
+		t.Fatalf("%s step %d: Count %d, want %d", name, step, c.Count(), m.count())
+	}
+
+	if c.MaxIndex() != m.max {
+		t.Fatalf("%s step %d: MaxIndex %d, want %d", name, step, c.MaxIndex(), m.max)
+	}
+
+	for i, v := range m.slots {
+		if got := c.GetIndex(i); got != v {
+			t.Fatalf("%s step %d: GetIndex(%d) %x, want %x", name, step, i, got, v)
+		}
+	}
+
+	rank, set := 0, []int{}
+	for from := -1; from <= len(m.slots); from++ {
+		if got, want := c.NextSet(from), m.nextSet(from); got != want {
+			t.Fatalf("%s step %d: NextSet(%d) %d, want %d", name, step, from, got, want)
+		}
+
+		if from >= 0 && from < len(m.slots) && m.slots[from] != 0 {
+			rank++
+			set = append(set, from)
+		}
+
+		if !full {
+			continue
+		}
+
+		if got := c.Rank(from); got != rank {
+			t.Fatalf("%s step %d: Rank(%d) %d, want %d", name, step, from, got, rank)
+		}
+	}
+
+	for n := -1; full && n <= len(set); n++ {
+		want := -1
+		if n >= 0 && n < len(set) {
+			want = set[n]
+		}
+
+		if got := c.Select(n); got != want {
+			t.Fatalf("%s step %d: Select(%d) %d, want %d", name, step, n, got, want)
+		}
+	}
+}
+
+func TestCachesAgreeWithModel(t *testing.T) {
+	for nbits := 1; nbits <= 64; nbits++ {
+		rd := rand.New(rand.NewSource(int64(nbits)))
+		for round := 0; round < 4; round++ {
+			capa := 1 + rd.Intn(300)
+			mask := ^uint64(0) >> uint(64-nbits)
+
+			for name, c := range cachesOf(nbits, capa) {
+				name = fmt.Sprintf("%s/%d", name, nbits)
+				m := &model{mask, make([]uint64, capa), 0}
+				rd := rand.New(rand.NewSource(int64(nbits*1000 + round)))
+
+				for step := 0; step < 400; step++ {
+					// a few indexes out of range must change nothing
+					index := rd.Intn(capa+2) - 1
+					inRange := index >= 0 && index < capa
+
+					switch op := rd.Intn(10); {
+					case op < 4:
+						want := inRange && m.slots[index]&1 == 0
+						if got := c.SetLastBit(index); got != want {
+							t.Fatalf("%s step %d: SetLastBit(%d) %v, want %v", name, step, index, got, want)
+						}
+
+						if inRange {
+							m.slots[index] |= 1
+							if index > m.max {
+								m.max = index
+							}
+						}
+
+					case op < 8:
+						value := rd.Uint64()
+						if rd.Intn(3) == 0 {
+							value = 0
+						}
+
+						c.ResetIndex(index, value)
+						if inRange {
+							// 1 bit caches are set by any value > 0
+							if nbits == 1 && value > 0 {
+								value = 1
+							}
+							m.slots[index] = value & mask
+							if index > m.max {
+								m.max = index
+							}
+						}
+
+					default:
+						c.ShiftOneBit()
+						for i, v := range m.slots {
+							m.slots[i] = v << 1 & mask
+						}
+					}
+
+					checkCache(t, name, step, c, m, step%16 == 0)
+				}
+			}
+		}
+	}
+}
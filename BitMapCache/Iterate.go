@@ -0,0 +1,493 @@
+package BitMapCache
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// every cache implements NextSet(from) as the first index >= from whose value != 0,
+// or -1, skipping empty words at once; ForEach is built on it, Rank and Select
+// count whole words with OnesCount64
+// Rank(index) is the number of set slots <= index
+// Select(n) is the index of the n-th set slot counted from 0, or -1
+
+type iterable interface {
+	NextSet(from int) int
+	GetIndex(index int) uint64
+}
+
+// call fn on every set slot in index order until it returns false
+func forEach(c iterable, fn func(index int, value uint64) bool) {
+	for i := c.NextSet(0); i >= 0; i = c.NextSet(i + 1) {
+		if !fn(i, c.GetIndex(i)) {
+			return
+		}
+	}
+}
+
+// position of the n-th set bit in word, n < OnesCount64(word)
+func selectInWord(word uint64, n int) int {
+	for ; n > 0; n-- {
+		word &= word - 1
+	}
+	return bits.TrailingZeros64(word)
+}
+
+// slots seen in blocks of one 64 bit word: presence(b) has a bit for every slot of
+// block b that is set, in slot order, so empty blocks are skipped with one test and
+// counted with OnesCount64; locate gives the block and bit of a slot, index the reverse
+type blockSlots struct {
+	capa     int
+	blocks   int
+	presence func(b int) uint64
+	locate   func(index int) (int, int)
+	index    func(b, bit int) int
+}
+
+// nbits wide slots packed from the low bit up, nbits a power of 2
+func packedSlots(nbits, capa int, word func(b int) uint64) *blockSlots {
+	per, low := 64/nbits, uint64(1)
+	if nbits < 64 {
+		low = ^uint64(0) / (1<<uint(nbits) - 1)
+	}
+
+	presence := func(b int) uint64 {
+		w := word(b)
+		for s := uint(1); s < uint(nbits); s <<= 1 {
+			w |= w >> s
+		}
+		return w & low
+	}
+
+	return &blockSlots{capa, (capa + per - 1) / per, presence,
+		func(index int) (int, int) { return index / per, index % per * nbits },
+		func(b, bit int) int { return b*per + bit/nbits }}
+}
+
+func (this *blockSlots) nextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	if from >= this.capa {
+		return -1
+	}
+
+	first, bit := this.locate(from)
+	for b := first; b < this.blocks; b++ {
+		word := this.presence(b)
+		if b == first {
+			word &= ^uint64(0) << uint(bit)
+		}
+
+		if word != 0 {
+			if index := this.index(b, bits.TrailingZeros64(word)); index < this.capa {
+				return index
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+func (this *blockSlots) rank(index int) int {
+	if index < 0 {
+		return 0
+	}
+
+	if index >= this.capa {
+		index = this.capa - 1
+	}
+
+	end, bit := this.locate(index)
+	count := 0
+	for b := 0; b < end; b++ {
+		count += bits.OnesCount64(this.presence(b))
+	}
+	return count + bits.OnesCount64(this.presence(end)<<uint(63-bit))
+}
+
+func (this *blockSlots) selectAt(n int) int {
+	if n < 0 {
+		return -1
+	}
+
+	for b := 0; b < this.blocks; b++ {
+		word := this.presence(b)
+		if c := bits.OnesCount64(word); n >= c {
+			n -= c
+			continue
+		}
+
+		if index := this.index(b, selectInWord(word, n)); index < this.capa {
+			return index
+		}
+		return -1
+	}
+	return -1
+}
+
+// -----------------1------------------------------
+func (this *Bit1Cache) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	for i := from &^ 63; i < this.capa; i += 64 {
+		word := loadWord(this.set, i>>3)
+		if i < from {
+			word &= ^uint64(0) << uint(from-i)
+		}
+
+		if word != 0 {
+			if index := i + bits.TrailingZeros64(word); index < this.capa {
+				return index
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+func (this *Bit1Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit1Cache) Rank(index int) int {
+	if index < 0 {
+		return 0
+	}
+
+	if index >= this.capa {
+		index = this.capa - 1
+	}
+
+	count, end := 0, index&^63
+	for i := 0; i < end; i += 64 {
+		count += bits.OnesCount64(loadWord(this.set, i>>3))
+	}
+	return count + bits.OnesCount64(loadWord(this.set, end>>3)<<uint(63-index&63))
+}
+
+func (this *Bit1Cache) Select(n int) int {
+	if n < 0 {
+		return -1
+	}
+
+	for i := 0; i < this.capa; i += 64 {
+		word := loadWord(this.set, i>>3)
+		if c := bits.OnesCount64(word); n >= c {
+			n -= c
+			continue
+		}
+
+		if index := i + selectInWord(word, n); index < this.capa {
+			return index
+		}
+		return -1
+	}
+	return -1
+}
+
+// -----------------2------------------------------
+// a block is 32 slots in 8 bytes (bit2Pos): byte pairs hold low bits in bits 0-3 of the
+// even byte and 4-7 of the odd byte, high bits are one byte later, so the word and the
+// word one byte later or'ed give every slot at bits 0-3 and 12-15 of each 16
+func (this *Bit2Cache) blocks() *blockSlots {
+	presence := func(b int) uint64 {
+		word := loadWord(this.set, 8*b)
+		next := word >> 8
+		if 8*b+8 < len(this.set) {
+			next |= uint64(this.set[8*b+8]) << 56
+		}
+		return (word | next) & 0xF00FF00FF00FF00F
+	}
+
+	return &blockSlots{this.capa, (this.capa + 31) / 32, presence,
+		func(index int) (int, int) { return index >> 5, (index&24)*2 + index&7 + (index&4)*2 },
+		func(b, bit int) int { return b<<5 + (bit>>4)*8 + bit&3 + (bit&8)>>1 }}
+}
+
+func (this *Bit2Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit2Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit2Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit2Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// ---------------------------4--------------------------------
+func (this *Bit4Cache) blocks() *blockSlots {
+	return packedSlots(4, this.capa, func(b int) uint64 {
+		return loadWord(this.set, 8*b)
+	})
+}
+
+func (this *Bit4Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit4Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit4Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit4Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// ---------------------------8--------------------------------
+func (this *Bit8Cache) blocks() *blockSlots {
+	return packedSlots(8, this.capa, func(b int) uint64 {
+		return loadWord(this.set, 8*b)
+	})
+}
+
+func (this *Bit8Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit8Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit8Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit8Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// ---------------------------16-------------------------------------
+func (this *Bit16Cache) blocks() *blockSlots {
+	return packedSlots(16, this.capa, func(b int) uint64 {
+		word := uint64(0)
+		for i := 4*b + 3; i >= 4*b; i-- {
+			if i < len(this.set) {
+				word = word<<16 | uint64(this.set[i])
+			}
+		}
+		return word
+	})
+}
+
+func (this *Bit16Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit16Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit16Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit16Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// -----------------------------32------------------------
+func (this *Bit32Cache) blocks() *blockSlots {
+	return packedSlots(32, this.capa, func(b int) uint64 {
+		word := uint64(0)
+		for i := 2*b + 1; i >= 2*b; i-- {
+			if i < len(this.set) {
+				word = word<<32 | uint64(this.set[i])
+			}
+		}
+		return word
+	})
+}
+
+func (this *Bit32Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit32Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit32Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit32Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// ---------------------------64----------------------------
+func (this *Bit64Cache) blocks() *blockSlots {
+	return packedSlots(64, this.capa, func(b int) uint64 {
+		return this.set[b]
+	})
+}
+
+func (this *Bit64Cache) NextSet(from int) int {
+	return this.blocks().nextSet(from)
+}
+
+func (this *Bit64Cache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *Bit64Cache) Rank(index int) int {
+	return this.blocks().rank(index)
+}
+
+func (this *Bit64Cache) Select(n int) int {
+	return this.blocks().selectAt(n)
+}
+
+// ---------------------------atomic----------------------------
+// lowest bit of every non-zero slot
+func (this *AtomicCache) collapse(word uint64) uint64 {
+	for s := uint(1); s < uint(this.bits); s <<= 1 {
+		word |= word >> s
+	}
+	return word & this.low
+}
+
+func (this *AtomicCache) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	if from >= this.capa {
+		return -1
+	}
+
+	w, off := this.locate(from)
+	word := this.collapse(atomic.LoadUint64(&this.words[w])) & (^uint64(0) << off)
+	for {
+		if word != 0 {
+			if index := w<<this.slotShift + bits.TrailingZeros64(word)>>this.bitShift; index < this.capa {
+				return index
+			}
+			return -1
+		}
+
+		if w++; w >= len(this.words) {
+			return -1
+		}
+		word = this.collapse(atomic.LoadUint64(&this.words[w]))
+	}
+}
+
+func (this *AtomicCache) ForEach(fn func(index int, value uint64) bool) {
+	forEach(this, fn)
+}
+
+func (this *AtomicCache) Rank(index int) int {
+	if index < 0 {
+		return 0
+	}
+
+	if index >= this.capa {
+		index = this.capa - 1
+	}
+
+	count, end := 0, index>>this.slotShift
+	for i := 0; i < end; i++ {
+		count += bits.OnesCount64(this.collapse(atomic.LoadUint64(&this.words[i])))
+	}
+
+	_, off := this.locate(index)
+	return count + bits.OnesCount64(this.collapse(atomic.LoadUint64(&this.words[end]))<<(63-off))
+}
+
+func (this *AtomicCache) Select(n int) int {
+	if n < 0 {
+		return -1
+	}
+
+	for i := range this.words {
+		word := this.collapse(atomic.LoadUint64(&this.words[i]))
+		if c := bits.OnesCount64(word); n >= c {
+			n -= c
+			continue
+		}
+
+		if index := i<<this.slotShift + selectInWord(word, n)>>this.bitShift; index < this.capa {
+			return index
+		}
+		return -1
+	}
+	return -1
+}
+
+// ---------------------------sparse----------------------------
+func (this *SparseCache) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+
+	i, _ := this.find(from >> 16)
+	for ; i < len(this.keys); i++ {
+		low := 0
+		if this.keys[i] == from>>16 {
+			low = from & 0xFFFF
+		}
+
+		if v := this.conts[i].next(uint16(low)); v >= 0 {
+			return this.keys[i]<<16 | v
+		}
+	}
+	return -1
+}
+
+func (this *SparseCache) ForEach(fn func(index int, value uint64) bool) {
+	for i, c := range this.conts {
+		for v := c.next(0); v >= 0; {
+			if !fn(this.keys[i]<<16|v, 1) {
+				return
+			}
+
+			if v == 0xFFFF {
+				break
+			}
+			v = c.next(uint16(v + 1))
+		}
+	}
+}
+
+func (this *SparseCache) Rank(index int) int {
+	count := 0
+	for i, c := range this.conts {
+		if key := this.keys[i]; key < index>>16 {
+			count += c.cardinality()
+		} else if key == index>>16 {
+			count += c.rank(uint16(index))
+		} else {
+			break
+		}
+	}
+	return count
+}
+
+func (this *SparseCache) Select(n int) int {
+	if n < 0 {
+		return -1
+	}
+
+	for i, c := range this.conts {
+		if card := c.cardinality(); n >= card {
+			n -= card
+			continue
+		}
+		return this.keys[i]<<16 | int(c.selectAt(n))
+	}
+	return -1
+}
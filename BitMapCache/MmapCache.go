@@ -0,0 +1,223 @@
+//go:build linux
+
+package BitMapCache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+file layout, the first page is the header, all fields host endian:
+
+	0  magic   uint32 "BMMF"
+	4  version uint16
+	6  clean   uint8  1 after Close, 0 while mapped
+	7  bits    uint8
+	8  order   uint64 0x0102030405060708, byte order check
+	16 capa    uint64
+	24 max     uint64
+	32 count   uint64
+	4096 words of AtomicCache
+*/
+
+const (
+	mmapMagic    = 0x464d4d42
+	mmapVersion  = 1
+	mmapHeadLen  = 4096
+	mmapByteMark = 0x0102030405060708
+)
+
+var (
+	ErrMmapFile   = errors.New("bad mmap cache file")
+	ErrMmapClosed = errors.New("mmap cache closed")
+)
+
+// file-backed AtomicCache, flags are written straight into the page cache
+// goroutine safe like AtomicCache, Sync/Close must not run concurrently
+type MmapCache struct {
+	*AtomicCache
+	file *os.File
+	data []byte
+}
+
+// open or create a mapped cache file
+// bits and capa must match an existing file, or be 0 to take them from the file
+// a file not closed cleanly has count and max index recounted
+func OpenMmapCache(path string, bits, capa int) (*MmapCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	this, err := openMmap(file, bits, capa)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return this, nil
+}
+
+func openMmap(file *os.File, bits, capa int) (*MmapCache, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	head, fresh := make([]byte, 40), info.Size() == 0
+	if !fresh {
+		if _, err := file.ReadAt(head, 0); err != nil {
+			return nil, err
+		}
+
+		// a crash after Truncate left the header unwritten
+		fresh = isZero(head)
+	}
+
+	if fresh {
+		if _, ok := mmapSize(bits, capa); !ok {
+			return nil, ErrUnknownCache
+		}
+	} else {
+		if binary.NativeEndian.Uint32(head[0:]) != mmapMagic ||
+			binary.NativeEndian.Uint16(head[4:]) != mmapVersion ||
+			binary.NativeEndian.Uint64(head[8:]) != mmapByteMark {
+			return nil, ErrMmapFile
+		}
+
+		fbits, fcapa := int(head[7]), int(binary.NativeEndian.Uint64(head[16:]))
+		if _, ok := mmapSize(fbits, fcapa); !ok {
+			return nil, ErrMmapFile
+		}
+
+		if bits == 0 && capa == 0 {
+			bits, capa = fbits, fcapa
+		}
+
+		if bits != fbits || capa != fcapa {
+			return nil, ErrSnapshotMismatch
+		}
+	}
+
+	size, _ := mmapSize(bits, capa)
+	if !fresh && info.Size() != int64(size) {
+		return nil, ErrMmapFile
+	}
+
+	if err := file.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &MmapCache{nil, file, data}
+	h := this.head()
+	if fresh {
+		h.magic, h.version, h.bits, h.order, h.capa = mmapMagic, mmapVersion, uint8(bits), mmapByteMark, uint64(capa)
+	}
+
+	nwords := (size - mmapHeadLen) / 8
+	words := unsafe.Slice((*uint64)(unsafe.Pointer(&data[mmapHeadLen])), nwords)
+	this.AtomicCache = newAtomicCache(bits, capa, words)
+
+	if h.clean != 0 {
+		this.restore(int(h.max), int(h.count))
+	} else {
+		this.recount()
+	}
+
+	h.clean = 0
+	if err := msync(data[:mmapHeadLen]); err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	return this, nil
+}
+
+// file size of a cache, false if the arguments are invalid or it can't be mapped
+func mmapSize(bits, capa int) (int, bool) {
+	if !validAtomic(bits, capa) {
+		return 0, false
+	}
+
+	per := 64 / bits
+	words := capa / per
+	if capa%per != 0 {
+		words++
+	}
+
+	if words > (math.MaxInt-mmapHeadLen)/8 {
+		return 0, false
+	}
+	return mmapHeadLen + 8*words, true
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type mmapHead struct {
+	magic   uint32
+	version uint16
+	clean   uint8
+	bits    uint8
+	order   uint64
+	capa    uint64
+	max     uint64
+	count   uint64
+}
+
+func (this *MmapCache) head() *mmapHead {
+	return (*mmapHead)(unsafe.Pointer(&this.data[0]))
+}
+
+func msync(b []byte) error {
+	_, _, e := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), syscall.MS_SYNC)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// flush flags, count and max index to the file
+func (this *MmapCache) Sync() error {
+	if this.data == nil {
+		return ErrMmapClosed
+	}
+
+	h := this.head()
+	h.max, h.count = uint64(this.MaxIndex()), uint64(this.Count())
+	return msync(this.data)
+}
+
+// sync, mark the file clean and unmap it, the cache must not be used after Close
+// but Sync and Close, which return ErrMmapClosed
+func (this *MmapCache) Close() error {
+	if err := this.Sync(); err != nil {
+		return err
+	}
+
+	this.head().clean = 1
+	if err := msync(this.data[:mmapHeadLen]); err != nil {
+		return err
+	}
+
+	if err := syscall.Munmap(this.data); err != nil {
+		return err
+	}
+
+	this.data = nil
+	return this.file.Close()
+}
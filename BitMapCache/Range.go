@@ -0,0 +1,391 @@
+package BitMapCache
+
+import (
+	"math/bits"
+)
+
+// range operations work on [from, to), clamped to [0, capacity)
+
+func (this *CacheCommon) clampRange(from, to int) (int, int, bool) {
+	if from < 0 {
+		from = 0
+	}
+
+	if to > this.capa {
+		to = this.capa
+	}
+
+	return from, to, from < to
+}
+
+// fix count and max index after every slot in [from, to) was set to value,
+// before is the number of slots != 0 in the range before
+func (this *CacheCommon) rangeSet(from, to, before int, value uint64) {
+	if value != 0 {
+		this.count += to - from - before
+		this.setMaxIndex(to - 1)
+	} else {
+		this.count -= before
+	}
+}
+
+// -----------------1------------------------------
+func (this *Bit1Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before, fill := this.CountRange(from, to), uint8(0)
+	if value > 0 {
+		value, fill = 1, 0xFF
+	}
+
+	for i := from; i < to; {
+		if i&7 == 0 && i+8 <= to {
+			this.set[i>>3] = fill
+			i += 8
+			continue
+		}
+
+		if fill != 0 {
+			this.set[i>>3] |= OpBits[i&7]
+		} else {
+			this.set[i>>3] &^= OpBits[i&7]
+		}
+		i++
+	}
+
+	this.touch(from>>3, (to-1)>>3+1)
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit1Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for i := from; i < to; {
+		switch {
+		case i&63 == 0 && i+64 <= to:
+			count += bits.OnesCount64(loadWord(this.set, i>>3))
+			i += 64
+		case i&7 == 0 && i+8 <= to:
+			count += bits.OnesCount8(this.set[i>>3])
+			i += 8
+		default:
+			count += int(this.GetIndex(i))
+			i++
+		}
+	}
+	return count
+}
+
+func (this *Bit1Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit1Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// -----------------2------------------------------
+func (this *Bit2Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	for i := from; i < to; i++ {
+		this.ResetIndex(i, value)
+	}
+}
+
+func (this *Bit2Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for i := from; i < to; i++ {
+		if this.GetIndex(i) != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit2Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit2Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// ---------------------------4--------------------------------
+func (this *Bit4Cache) setNibble(index int, value uint8) {
+	idx := index >> 1
+	if index&1 == 0 {
+		this.set[idx] = (this.set[idx] & 0xF0) | value
+	} else {
+		this.set[idx] = (this.set[idx] & 0xF) | value<<4
+	}
+}
+
+func (this *Bit4Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before, value := this.CountRange(from, to), value&0xF
+	nibble := uint8(value)
+	for i := from; i < to; {
+		if i&1 == 0 && i+2 <= to {
+			this.set[i>>1] = nibble | nibble<<4
+			i += 2
+		} else {
+			this.setNibble(i, nibble)
+			i++
+		}
+	}
+
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit4Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for i := from; i < to; i++ {
+		if i&1 == 0 && i+2 <= to && this.set[i>>1] == 0 {
+			i++
+			continue
+		}
+
+		if this.GetIndex(i) != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit4Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit4Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// ---------------------------8--------------------------------
+func (this *Bit8Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before, value := this.CountRange(from, to), uint64(uint8(value))
+	fill := this.set[from:to]
+	for i := range fill {
+		fill[i] = uint8(value)
+	}
+
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit8Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for _, v := range this.set[from:to] {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit8Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit8Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// ---------------------------16-------------------------------------
+func (this *Bit16Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before, value := this.CountRange(from, to), uint64(uint16(value))
+	fill := this.set[from:to]
+	for i := range fill {
+		fill[i] = uint16(value)
+	}
+
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit16Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for _, v := range this.set[from:to] {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit16Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit16Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// -----------------------------32------------------------
+func (this *Bit32Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before, value := this.CountRange(from, to), uint64(uint32(value))
+	fill := this.set[from:to]
+	for i := range fill {
+		fill[i] = uint32(value)
+	}
+
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit32Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for _, v := range this.set[from:to] {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit32Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit32Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// ---------------------------64----------------------------
+func (this *Bit64Cache) SetRange(from, to int, value uint64) {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return
+	}
+
+	before := this.CountRange(from, to)
+	fill := this.set[from:to]
+	for i := range fill {
+		fill[i] = value
+	}
+
+	this.rangeSet(from, to, before, value)
+}
+
+func (this *Bit64Cache) CountRange(from, to int) int {
+	from, to, ok := this.clampRange(from, to)
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for _, v := range this.set[from:to] {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *Bit64Cache) ClearRange(from, to int) {
+	this.SetRange(from, to, 0)
+}
+
+// SetLastBit on every index, return how many were set the first time
+func (this *Bit64Cache) SetMany(indexes []int) int {
+	count := 0
+	for _, index := range indexes {
+		if index >= 0 && index < this.capa && this.SetLastBit(index) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,147 @@
+package BitMapCache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var ErrCapacityMismatch = errors.New("caches have different capacity")
+
+func opAnd(a, b uint64) uint64    { return a & b }
+func opOr(a, b uint64) uint64     { return a | b }
+func opXor(a, b uint64) uint64    { return a ^ b }
+func opAndNot(a, b uint64) uint64 { return a &^ b }
+
+func (this *Bit1Cache) Clone() *Bit1Cache {
+	set := make([]uint8, len(this.set))
+	copy(set, this.set)
+	return &Bit1Cache{this.CacheCommon, set, nil}
+}
+
+// recount flags and max index after a set operation
+func (this *Bit1Cache) recount() {
+	count, max := 0, 0
+	for i := 0; i < len(this.set); i += 8 {
+		word := loadWord(this.set, i)
+		if word != 0 {
+			count += bits.OnesCount64(word)
+			max = i<<3 + 63 - bits.LeadingZeros64(word)
+		}
+	}
+	this.count, this.max = count, max
+}
+
+// 8 flags bytes as a little endian word, short tail is zero padded
+func loadWord(set []uint8, i int) uint64 {
+	if i+8 <= len(set) {
+		return binary.LittleEndian.Uint64(set[i:])
+	}
+
+	word := uint64(0)
+	for j := len(set) - 1; j >= i; j-- {
+		word = word<<8 | uint64(set[j])
+	}
+	return word
+}
+
+func storeWord(set []uint8, i int, word uint64) {
+	if i+8 <= len(set) {
+		binary.LittleEndian.PutUint64(set[i:], word)
+		return
+	}
+
+	for j := i; j < len(set); j++ {
+		set[j] = uint8(word)
+		word >>= 8
+	}
+}
+
+func (this *Bit1Cache) apply(other *Bit1Cache, op func(a, b uint64) uint64) error {
+	if this.capa != other.capa {
+		return ErrCapacityMismatch
+	}
+
+	for i := 0; i < len(this.set); i += 8 {
+		old := loadWord(this.set, i)
+		if word := op(old, loadWord(other.set, i)); word != old {
+			storeWord(this.set, i, word)
+			this.touch(i, i+8)
+		}
+	}
+
+	this.recount()
+	return nil
+}
+
+func countWith(a, b *Bit1Cache, op func(a, b uint64) uint64) (int, error) {
+	if a.capa != b.capa {
+		return 0, ErrCapacityMismatch
+	}
+
+	count := 0
+	for i := 0; i < len(a.set); i += 8 {
+		count += bits.OnesCount64(op(loadWord(a.set, i), loadWord(b.set, i)))
+	}
+	return count, nil
+}
+
+func combine(a, b *Bit1Cache, op func(a, b uint64) uint64) (*Bit1Cache, error) {
+	if a.capa != b.capa {
+		return nil, ErrCapacityMismatch
+	}
+
+	res := a.Clone()
+	res.apply(b, op)
+	return res, nil
+}
+
+// this = this & other
+func (this *Bit1Cache) And(other *Bit1Cache) error {
+	return this.apply(other, opAnd)
+}
+
+// this = this | other
+func (this *Bit1Cache) Or(other *Bit1Cache) error {
+	return this.apply(other, opOr)
+}
+
+// this = this ^ other
+func (this *Bit1Cache) Xor(other *Bit1Cache) error {
+	return this.apply(other, opXor)
+}
+
+// this = this &^ other
+func (this *Bit1Cache) AndNot(other *Bit1Cache) error {
+	return this.apply(other, opAndNot)
+}
+
+// new cache = a & b
+func And(a, b *Bit1Cache) (*Bit1Cache, error) {
+	return combine(a, b, opAnd)
+}
+
+// new cache = a | b
+func Or(a, b *Bit1Cache) (*Bit1Cache, error) {
+	return combine(a, b, opOr)
+}
+
+// new cache = a ^ b
+func Xor(a, b *Bit1Cache) (*Bit1Cache, error) {
+	return combine(a, b, opXor)
+}
+
+// new cache = a &^ b
+func AndNot(a, b *Bit1Cache) (*Bit1Cache, error) {
+	return combine(a, b, opAndNot)
+}
+
+// count of a & b without building it
+func AndCount(a, b *Bit1Cache) (int, error) {
+	return countWith(a, b, opAnd)
+}
+
+// count of a | b without building it
+func OrCount(a, b *Bit1Cache) (int, error) {
+	return countWith(a, b, opOr)
+}
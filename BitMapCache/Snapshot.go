@@ -0,0 +1,303 @@
+package BitMapCache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+snapshot layout, all fields little endian:
+
+	0  magic   uint32 "BMAP"
+	4  version uint16
+	6  kind    uint8  0: BitNCache, 1: AtomicCache, 2: SparseCache, 3: HistoryCache
+	7  bits    uint8
+	8  capa    uint64
+	16 max     uint64 MaxIndex()
+	24 count   uint64 Count()
+	32 length  uint64 payload bytes
+	40 -       uint32 reserved
+	44 crc     uint32 crc32(IEEE) of byte 0-43
+	48 payload, written by WriteTo
+	.. crc     uint32 crc32(IEEE) of payload
+*/
+
+const (
+	snapshotMagic   = 0x50414d42
+	snapshotVersion = 1
+	snapshotHeadLen = 48
+)
+
+const (
+	kindBitN = iota
+	kindAtomic
+	kindSparse
+	kindHistory
+)
+
+var (
+	ErrSnapshotMagic    = errors.New("not a bitmap cache snapshot")
+	ErrSnapshotVersion  = errors.New("unknown snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	ErrSnapshotMismatch = errors.New("snapshot doesn't match the cache")
+	ErrUnknownCache     = errors.New("unknown cache type")
+)
+
+// caches which can be saved in a snapshot
+type snapshoter interface {
+	Cache
+	kind() int
+	byteLen() int
+	restore(max, count int)
+}
+
+type snapshotHead struct {
+	kind   int
+	bits   int
+	capa   int
+	max    int
+	count  int
+	length int
+}
+
+// create an empty cache described by a snapshot head
+func newCache(kind, bits, capa int) (Cache, error) {
+	switch kind {
+	case kindBitN:
+		switch bits {
+		case 1:
+			return NewBit1Cache(capa), nil
+		case 2:
+			return NewBit2Cache(capa), nil
+		case 4:
+			return NewBit4Cache(capa), nil
+		case 8:
+			return NewBit8Cache(capa), nil
+		case 16:
+			return NewBit16Cache(capa), nil
+		case 32:
+			return NewBit32Cache(capa), nil
+		case 64:
+			return NewBit64Cache(capa), nil
+		}
+
+	case kindAtomic:
+		if c := NewAtomicCache(bits, capa); c != nil {
+			return c, nil
+		}
+
+	case kindSparse:
+		if bits == 1 {
+			return NewSparseCache(capa), nil
+		}
+
+	case kindHistory:
+		if c := NewHistoryCache(bits, capa); c != nil {
+			return c, nil
+		}
+	}
+
+	return nil, ErrUnknownCache
+}
+
+func (this *snapshotHead) encode() []byte {
+	buf := make([]byte, snapshotHeadLen)
+	binary.LittleEndian.PutUint32(buf[0:], snapshotMagic)
+	binary.LittleEndian.PutUint16(buf[4:], snapshotVersion)
+	buf[6], buf[7] = uint8(this.kind), uint8(this.bits)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(this.capa))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(this.max))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(this.count))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(this.length))
+	binary.LittleEndian.PutUint32(buf[44:], crc32.ChecksumIEEE(buf[:44]))
+	return buf
+}
+
+func (this *snapshotHead) decode(buf []byte) error {
+	if binary.LittleEndian.Uint32(buf[0:]) != snapshotMagic {
+		return ErrSnapshotMagic
+	}
+
+	if binary.LittleEndian.Uint16(buf[4:]) != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+
+	if binary.LittleEndian.Uint32(buf[44:]) != crc32.ChecksumIEEE(buf[:44]) {
+		return ErrSnapshotChecksum
+	}
+
+	capa := binary.LittleEndian.Uint64(buf[8:])
+	max := binary.LittleEndian.Uint64(buf[16:])
+	count := binary.LittleEndian.Uint64(buf[24:])
+	length := binary.LittleEndian.Uint64(buf[32:])
+	if capa == 0 || capa > 1<<40 || max >= capa || count > capa || length > 8*(capa+64) {
+		return ErrSnapshotMismatch
+	}
+
+	this.kind, this.bits = int(buf[6]), int(buf[7])
+	this.capa, this.max, this.count, this.length = int(capa), int(max), int(count), int(length)
+	return nil
+}
+
+// write a self-describing snapshot of c
+func SaveCache(w io.Writer, c Cache) error {
+	sc, ok := c.(snapshoter)
+	if !ok {
+		return ErrUnknownCache
+	}
+
+	head := snapshotHead{sc.kind(), c.Bits(), c.Capacity(), c.MaxIndex(), c.Count(), sc.byteLen()}
+	if _, err := w.Write(head.encode()); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	nw, err := c.WriteTo(io.MultiWriter(w, crc))
+	if err != nil {
+		return err
+	}
+
+	if nw != head.length {
+		return io.ErrShortWrite
+	}
+
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc.Sum32())
+	_, err = w.Write(sum)
+	return err
+}
+
+func readSnapshot(r io.Reader, head *snapshotHead, sc snapshoter) error {
+	// the size of a sparse cache depends on its content
+	if sc.kind() != kindSparse && sc.byteLen() != head.length {
+		return ErrSnapshotMismatch
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := sc.ReadFrom(io.TeeReader(io.LimitReader(r, int64(head.length)), crc)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(sum) != crc.Sum32() {
+		return ErrSnapshotChecksum
+	}
+
+	sc.restore(head.max, head.count)
+	return nil
+}
+
+// bytes left in r, false if r can't tell
+func remaining(r io.Reader) (int64, bool) {
+	switch rd := r.(type) {
+	case interface{ Len() int }:
+		return int64(rd.Len()), true
+
+	case *os.File:
+		st, err := rd.Stat()
+		if err != nil || !st.Mode().IsRegular() {
+			return 0, false
+		}
+
+		pos, err := rd.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return st.Size() - pos, true
+	}
+	return 0, false
+}
+
+// the payload must be able to hold capa slots before the cache is allocated,
+// and r must hold the payload, so a broken or hostile header can't force a huge allocation
+func checkPayload(r io.Reader, head *snapshotHead) error {
+	if head.kind == kindSparse {
+		return nil
+	}
+
+	if head.bits < 1 || head.bits > 64 || uint64(head.capa)*uint64(head.bits)/8 > uint64(head.length) {
+		return ErrSnapshotMismatch
+	}
+
+	if left, ok := remaining(r); ok && left < int64(head.length)+4 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// create the cache saved by SaveCache
+func LoadCache(r io.Reader) (Cache, error) {
+	buf, head := make([]byte, snapshotHeadLen), snapshotHead{}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if err := head.decode(buf); err != nil {
+		return nil, err
+	}
+
+	// a stream can't tell its size: the payload is read first, into a buffer
+	// growing with the bytes received
+	if _, ok := remaining(r); !ok {
+		payload := &bytes.Buffer{}
+		if _, err := io.CopyN(payload, r, int64(head.length)+4); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		r = payload
+	}
+
+	if err := checkPayload(r, &head); err != nil {
+		return nil, err
+	}
+
+	c, err := newCache(head.kind, head.bits, head.capa)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readSnapshot(r, &head, c.(snapshoter)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load a snapshot into c, type, bits and capacity must be the same
+// c is undefined when an error is returned after the header was accepted
+func ReadSnapshot(r io.Reader, c Cache) error {
+	sc, ok := c.(snapshoter)
+	if !ok {
+		return ErrUnknownCache
+	}
+
+	buf, head := make([]byte, snapshotHeadLen), snapshotHead{}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	if err := head.decode(buf); err != nil {
+		return err
+	}
+
+	if head.kind != sc.kind() || head.bits != c.Bits() || head.capa != c.Capacity() {
+		return ErrSnapshotMismatch
+	}
+
+	return readSnapshot(r, &head, sc)
+}
@@ -0,0 +1,701 @@
+package BitMapCache
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// compressed 1 bit cache (roaring bitmap), memory scales with the number of set ids
+// ids are split into chunks of 65536, a chunk is stored as a sorted array,
+// a bitmap or a list of runs, whichever fits
+type SparseCache struct {
+	CacheCommon
+	keys  []int // chunk = index >> 16, sorted
+	conts []container
+}
+
+const (
+	arrayMaxSize  = 4096 // array chunk above this size becomes a bitmap
+	bitmapWords   = 1024
+	runMaxSize    = 2048 // run chunk above this size becomes a bitmap
+	containerHead = 9    // key uint32, type uint8, size uint32
+)
+
+const (
+	typeArray = iota + 1
+	typeBitmap
+	typeRun
+)
+
+var ErrSparseFormat = errors.New("bad sparse cache data")
+
+type container interface {
+	add(x uint16) (container, bool)
+	remove(x uint16) (container, bool)
+	contains(x uint16) bool
+	cardinality() int
+	sizeInBytes() int
+	runOptimize() container
+	encode(buf []byte) []byte
+
+	next(x uint16) int     // first value >= x, -1 if none
+	rank(x uint16) int     // number of values <= x
+	selectAt(n int) uint16 // n-th value, n < cardinality
+}
+
+func NewSparseCache(capa int) *SparseCache {
+	return &SparseCache{CacheCommon{1, capa, 0, 0}, nil, nil}
+}
+
+func (this *SparseCache) find(key int) (int, bool) {
+	i := sort.SearchInts(this.keys, key)
+	return i, i < len(this.keys) && this.keys[i] == key
+}
+
+func (this *SparseCache) ShiftOneBit() {
+	this.resetCount()
+	this.keys, this.conts = nil, nil
+}
+
+func (this *SparseCache) SetLastBit(index int) bool {
+	if index < 0 || index >= this.capa {
+		return false
+	}
+
+	this.setMaxIndex(index)
+
+	key, low := index>>16, uint16(index)
+	i, ok := this.find(key)
+	if !ok {
+		this.keys = append(this.keys, 0)
+		copy(this.keys[i+1:], this.keys[i:])
+		this.keys[i] = key
+
+		this.conts = append(this.conts, nil)
+		copy(this.conts[i+1:], this.conts[i:])
+		this.conts[i] = &arrayContainer{}
+	}
+
+	c, added := this.conts[i].add(low)
+	this.conts[i] = c
+	if added {
+		this.addCount()
+	}
+	return added
+}
+
+func (this *SparseCache) GetIndex(index int) uint64 {
+	if i, ok := this.find(index >> 16); ok && this.conts[i].contains(uint16(index)) {
+		return 1
+	}
+	return 0
+}
+
+func (this *SparseCache) ResetIndex(index int, value uint64) {
+	if value > 0 {
+		this.SetLastBit(index)
+		return
+	}
+
+	if index < 0 || index >= this.capa {
+		return
+	}
+
+	this.setMaxIndex(index)
+	i, ok := this.find(index >> 16)
+	if !ok {
+		return
+	}
+
+	c, removed := this.conts[i].remove(uint16(index))
+	this.conts[i] = c
+	if !removed {
+		return
+	}
+
+	this.count--
+	if c.cardinality() == 0 {
+		this.keys = append(this.keys[:i], this.keys[i+1:]...)
+		this.conts = append(this.conts[:i], this.conts[i+1:]...)
+	}
+}
+
+// convert chunks to runs where it saves memory
+func (this *SparseCache) RunOptimize() {
+	for i, c := range this.conts {
+		this.conts[i] = c.runOptimize()
+	}
+}
+
+// approximate memory used by the chunks
+func (this *SparseCache) SizeInBytes() int {
+	size := 0
+	for _, c := range this.conts {
+		size += 8 + c.sizeInBytes()
+	}
+	return size
+}
+
+func (this *SparseCache) kind() int {
+	return kindSparse
+}
+
+// serialized size
+func (this *SparseCache) byteLen() int {
+	size := 4
+	for _, c := range this.conts {
+		size += containerHead + c.sizeInBytes()
+	}
+	return size
+}
+
+// layout, little endian: chunks uint32, then every chunk:
+// key uint32, type uint8, size uint32 (values or runs), data
+func (this *SparseCache) WriteTo(w io.Writer) (int, error) {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(this.conts)))
+	total := 0
+	for i, c := range this.conts {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(this.keys[i]))
+		buf = c.encode(buf)
+
+		if len(buf) >= ioChunk || i == len(this.conts)-1 {
+			nw, err := w.Write(buf)
+			total += nw
+			if err != nil {
+				return total, err
+			}
+			buf = buf[:0]
+		}
+	}
+
+	if len(buf) > 0 {
+		nw, err := w.Write(buf)
+		return total + nw, err
+	}
+	return total, nil
+}
+
+// replace content with data written by WriteTo, count and max index are recounted
+func (this *SparseCache) ReadFrom(r io.Reader) (int, error) {
+	head := make([]byte, containerHead)
+	if _, err := io.ReadFull(r, head[:4]); err != nil {
+		return 0, err
+	}
+
+	// chunks grow with the data read, a hostile count can't force a huge allocation
+	n, total := int(binary.LittleEndian.Uint32(head)), 4
+	if n > (this.capa-1)>>16+1 {
+		return total, ErrSparseFormat
+	}
+
+	var keys []int
+	var conts []container
+	for i := 0; i < n; i++ {
+		nr, err := io.ReadFull(r, head)
+		total += nr
+		if err != nil {
+			return total, err
+		}
+
+		key, typ, size := int(binary.LittleEndian.Uint32(head)), head[4], int(binary.LittleEndian.Uint32(head[5:]))
+		if (len(keys) > 0 && key <= keys[len(keys)-1]) || key > (this.capa-1)>>16 {
+			return total, ErrSparseFormat
+		}
+
+		var c container
+		switch {
+		case typ == typeArray && size <= arrayMaxSize:
+			c = &arrayContainer{make([]uint16, size)}
+		case typ == typeBitmap && size == bitmapWords:
+			c = &bitmapContainer{}
+		case typ == typeRun && size <= runMaxSize:
+			c = &runContainer{make([]run, size), 0}
+		default:
+			return total, ErrSparseFormat
+		}
+
+		data := make([]byte, c.sizeInBytes())
+		nr, err = io.ReadFull(r, data)
+		total += nr
+		if err != nil {
+			return total, err
+		}
+
+		if !decodeContainer(c, data) {
+			return total, ErrSparseFormat
+		}
+		keys, conts = append(keys, key), append(conts, c)
+	}
+
+	this.keys, this.conts = keys, conts
+	this.count, this.max = 0, 0
+	for i, c := range conts {
+		this.count += c.cardinality()
+		if i == len(conts)-1 {
+			this.max = keys[i]<<16 | int(lastOf(c))
+		}
+	}
+	return total, nil
+}
+
+func decodeContainer(c container, data []byte) bool {
+	switch c := c.(type) {
+	case *arrayContainer:
+		for i := range c.vals {
+			c.vals[i] = binary.LittleEndian.Uint16(data[2*i:])
+			if i > 0 && c.vals[i] <= c.vals[i-1] {
+				return false
+			}
+		}
+		return len(c.vals) > 0
+
+	case *bitmapContainer:
+		for i := range c.words {
+			c.words[i] = binary.LittleEndian.Uint64(data[8*i:])
+			c.card += bits.OnesCount64(c.words[i])
+		}
+		return c.card > arrayMaxSize
+
+	case *runContainer:
+		for i := range c.runs {
+			c.runs[i].start = binary.LittleEndian.Uint16(data[4*i:])
+			c.runs[i].last = binary.LittleEndian.Uint16(data[4*i+2:])
+			if c.runs[i].last < c.runs[i].start || (i > 0 && int(c.runs[i].start) <= int(c.runs[i-1].last)+1) {
+				return false
+			}
+			c.card += int(c.runs[i].last-c.runs[i].start) + 1
+		}
+		return len(c.runs) > 0
+	}
+	return false
+}
+
+// biggest value in a non-empty container
+func lastOf(c container) uint16 {
+	switch c := c.(type) {
+	case *arrayContainer:
+		return c.vals[len(c.vals)-1]
+
+	case *bitmapContainer:
+		for i := bitmapWords - 1; i >= 0; i-- {
+			if c.words[i] != 0 {
+				return uint16(i<<6 + 63 - bits.LeadingZeros64(c.words[i]))
+			}
+		}
+
+	case *runContainer:
+		return c.runs[len(c.runs)-1].last
+	}
+	return 0
+}
+
+// ---------------------------array--------------------------------
+type arrayContainer struct {
+	vals []uint16
+}
+
+func (this *arrayContainer) search(x uint16) (int, bool) {
+	i := sort.Search(len(this.vals), func(i int) bool { return this.vals[i] >= x })
+	return i, i < len(this.vals) && this.vals[i] == x
+}
+
+func (this *arrayContainer) add(x uint16) (container, bool) {
+	i, ok := this.search(x)
+	if ok {
+		return this, false
+	}
+
+	if len(this.vals) >= arrayMaxSize {
+		return this.toBitmap().add(x)
+	}
+
+	this.vals = append(this.vals, 0)
+	copy(this.vals[i+1:], this.vals[i:])
+	this.vals[i] = x
+	return this, true
+}
+
+func (this *arrayContainer) remove(x uint16) (container, bool) {
+	i, ok := this.search(x)
+	if !ok {
+		return this, false
+	}
+
+	this.vals = append(this.vals[:i], this.vals[i+1:]...)
+	return this, true
+}
+
+func (this *arrayContainer) contains(x uint16) bool {
+	_, ok := this.search(x)
+	return ok
+}
+
+func (this *arrayContainer) next(x uint16) int {
+	if i, _ := this.search(x); i < len(this.vals) {
+		return int(this.vals[i])
+	}
+	return -1
+}
+
+func (this *arrayContainer) rank(x uint16) int {
+	i, ok := this.search(x)
+	if ok {
+		i++
+	}
+	return i
+}
+
+func (this *arrayContainer) selectAt(n int) uint16 {
+	return this.vals[n]
+}
+
+func (this *arrayContainer) cardinality() int {
+	return len(this.vals)
+}
+
+func (this *arrayContainer) sizeInBytes() int {
+	return 2 * len(this.vals)
+}
+
+func (this *arrayContainer) toBitmap() *bitmapContainer {
+	bc := &bitmapContainer{}
+	for _, v := range this.vals {
+		bc.words[v>>6] |= 1 << (v & 63)
+	}
+	bc.card = len(this.vals)
+	return bc
+}
+
+func (this *arrayContainer) numRuns() int {
+	runs := 0
+	for i, v := range this.vals {
+		if i == 0 || v != this.vals[i-1]+1 {
+			runs++
+		}
+	}
+	return runs
+}
+
+func (this *arrayContainer) runOptimize() container {
+	if runs := this.numRuns(); 4*runs < this.sizeInBytes() {
+		rc := &runContainer{make([]run, 0, runs), len(this.vals)}
+		for i, v := range this.vals {
+			if i == 0 || v != this.vals[i-1]+1 {
+				rc.runs = append(rc.runs, run{v, v})
+			} else {
+				rc.runs[len(rc.runs)-1].last = v
+			}
+		}
+		return rc
+	}
+	return this
+}
+
+func (this *arrayContainer) encode(buf []byte) []byte {
+	buf = append(buf, typeArray)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(this.vals)))
+	for _, v := range this.vals {
+		buf = binary.LittleEndian.AppendUint16(buf, v)
+	}
+	return buf
+}
+
+// ---------------------------bitmap-------------------------------
+type bitmapContainer struct {
+	words [bitmapWords]uint64
+	card  int
+}
+
+func (this *bitmapContainer) add(x uint16) (container, bool) {
+	w, flg := &this.words[x>>6], uint64(1)<<(x&63)
+	if *w&flg != 0 {
+		return this, false
+	}
+
+	*w |= flg
+	this.card++
+	return this, true
+}
+
+func (this *bitmapContainer) remove(x uint16) (container, bool) {
+	w, flg := &this.words[x>>6], uint64(1)<<(x&63)
+	if *w&flg == 0 {
+		return this, false
+	}
+
+	*w &^= flg
+	this.card--
+	if this.card <= arrayMaxSize {
+		return this.toArray(), true
+	}
+	return this, true
+}
+
+func (this *bitmapContainer) contains(x uint16) bool {
+	return this.words[x>>6]&(1<<(x&63)) != 0
+}
+
+func (this *bitmapContainer) next(x uint16) int {
+	i := int(x >> 6)
+	word := this.words[i] & (^uint64(0) << (x & 63))
+	for {
+		if word != 0 {
+			return i<<6 + bits.TrailingZeros64(word)
+		}
+
+		if i++; i >= bitmapWords {
+			return -1
+		}
+		word = this.words[i]
+	}
+}
+
+func (this *bitmapContainer) rank(x uint16) int {
+	count, i := 0, int(x>>6)
+	for _, w := range this.words[:i] {
+		count += bits.OnesCount64(w)
+	}
+	return count + bits.OnesCount64(this.words[i]<<(63-x&63))
+}
+
+func (this *bitmapContainer) selectAt(n int) uint16 {
+	for i, w := range this.words {
+		if c := bits.OnesCount64(w); n >= c {
+			n -= c
+			continue
+		}
+		return uint16(i<<6 + selectInWord(w, n))
+	}
+	return 0
+}
+
+func (this *bitmapContainer) cardinality() int {
+	return this.card
+}
+
+func (this *bitmapContainer) sizeInBytes() int {
+	return 8 * bitmapWords
+}
+
+func (this *bitmapContainer) toArray() *arrayContainer {
+	ac := &arrayContainer{make([]uint16, 0, this.card)}
+	for i, w := range this.words {
+		for ; w != 0; w &= w - 1 {
+			ac.vals = append(ac.vals, uint16(i<<6+bits.TrailingZeros64(w)))
+		}
+	}
+	return ac
+}
+
+func (this *bitmapContainer) numRuns() int {
+	runs := 0
+	for i, w := range this.words {
+		carry := uint64(0)
+		if i > 0 {
+			carry = this.words[i-1] >> 63
+		}
+		runs += bits.OnesCount64(w &^ (w<<1 | carry))
+	}
+	return runs
+}
+
+func (this *bitmapContainer) runOptimize() container {
+	runs := this.numRuns()
+	if 4*runs >= this.sizeInBytes() {
+		return this
+	}
+
+	rc := &runContainer{make([]run, 0, runs), this.card}
+	for i, w := range this.words {
+		for ; w != 0; w &= w - 1 {
+			v := uint16(i<<6 + bits.TrailingZeros64(w))
+			if n := len(rc.runs); n > 0 && int(rc.runs[n-1].last)+1 == int(v) {
+				rc.runs[n-1].last = v
+			} else {
+				rc.runs = append(rc.runs, run{v, v})
+			}
+		}
+	}
+	return rc
+}
+
+func (this *bitmapContainer) encode(buf []byte) []byte {
+	buf = append(buf, typeBitmap)
+	buf = binary.LittleEndian.AppendUint32(buf, bitmapWords)
+	for _, w := range this.words {
+		buf = binary.LittleEndian.AppendUint64(buf, w)
+	}
+	return buf
+}
+
+// ---------------------------run----------------------------------
+// [start, last]
+type run struct {
+	start uint16
+	last  uint16
+}
+
+type runContainer struct {
+	runs []run
+	card int
+}
+
+// first run with last >= x
+func (this *runContainer) search(x uint16) int {
+	return sort.Search(len(this.runs), func(i int) bool { return this.runs[i].last >= x })
+}
+
+func (this *runContainer) add(x uint16) (container, bool) {
+	i := this.search(x)
+	if i < len(this.runs) && this.runs[i].start <= x {
+		return this, false
+	}
+
+	prev := i > 0 && int(this.runs[i-1].last)+1 == int(x)
+	next := i < len(this.runs) && int(x)+1 == int(this.runs[i].start)
+
+	switch {
+	case prev && next:
+		this.runs[i-1].last = this.runs[i].last
+		this.runs = append(this.runs[:i], this.runs[i+1:]...)
+	case prev:
+		this.runs[i-1].last = x
+	case next:
+		this.runs[i].start = x
+	default:
+		this.runs = append(this.runs, run{})
+		copy(this.runs[i+1:], this.runs[i:])
+		this.runs[i] = run{x, x}
+	}
+
+	this.card++
+	if len(this.runs) > runMaxSize {
+		return this.toEfficient(), true
+	}
+	return this, true
+}
+
+func (this *runContainer) remove(x uint16) (container, bool) {
+	i := this.search(x)
+	if i == len(this.runs) || this.runs[i].start > x {
+		return this, false
+	}
+
+	r := this.runs[i]
+	switch {
+	case r.start == r.last:
+		this.runs = append(this.runs[:i], this.runs[i+1:]...)
+	case x == r.start:
+		this.runs[i].start++
+	case x == r.last:
+		this.runs[i].last--
+	default:
+		this.runs[i].last = x - 1
+		this.runs = append(this.runs, run{})
+		copy(this.runs[i+2:], this.runs[i+1:])
+		this.runs[i+1] = run{x + 1, r.last}
+	}
+
+	this.card--
+	if len(this.runs) > runMaxSize {
+		return this.toEfficient(), true
+	}
+	return this, true
+}
+
+func (this *runContainer) contains(x uint16) bool {
+	i := this.search(x)
+	return i < len(this.runs) && this.runs[i].start <= x
+}
+
+func (this *runContainer) next(x uint16) int {
+	i := this.search(x)
+	if i == len(this.runs) {
+		return -1
+	}
+
+	if r := this.runs[i]; r.start > x {
+		return int(r.start)
+	}
+	return int(x)
+}
+
+func (this *runContainer) rank(x uint16) int {
+	count := 0
+	for _, r := range this.runs {
+		if r.start > x {
+			break
+		}
+
+		if r.last >= x {
+			return count + int(x-r.start) + 1
+		}
+		count += int(r.last-r.start) + 1
+	}
+	return count
+}
+
+func (this *runContainer) selectAt(n int) uint16 {
+	for _, r := range this.runs {
+		if size := int(r.last-r.start) + 1; n >= size {
+			n -= size
+			continue
+		}
+		return r.start + uint16(n)
+	}
+	return 0
+}
+
+func (this *runContainer) cardinality() int {
+	return this.card
+}
+
+func (this *runContainer) sizeInBytes() int {
+	return 4 * len(this.runs)
+}
+
+// array or bitmap, whichever is smaller
+func (this *runContainer) toEfficient() container {
+	if this.card <= arrayMaxSize {
+		ac := &arrayContainer{make([]uint16, 0, this.card)}
+		for _, r := range this.runs {
+			for v := int(r.start); v <= int(r.last); v++ {
+				ac.vals = append(ac.vals, uint16(v))
+			}
+		}
+		return ac
+	}
+
+	bc := &bitmapContainer{card: this.card}
+	for _, r := range this.runs {
+		for v := int(r.start); v <= int(r.last); v++ {
+			bc.words[v>>6] |= 1 << uint(v&63)
+		}
+	}
+	return bc
+}
+
+func (this *runContainer) runOptimize() container {
+	size := 2 * this.card
+	if this.card > arrayMaxSize {
+		size = 8 * bitmapWords
+	}
+
+	if this.sizeInBytes() > size {
+		return this.toEfficient()
+	}
+	return this
+}
+
+func (this *runContainer) encode(buf []byte) []byte {
+	buf = append(buf, typeRun)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(this.runs)))
+	for _, r := range this.runs {
+		buf = binary.LittleEndian.AppendUint16(buf, r.start)
+		buf = binary.LittleEndian.AppendUint16(buf, r.last)
+	}
+	return buf
+}
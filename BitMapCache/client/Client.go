@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrClosed = errors.New("client closed")
+
+// client of the bitmap cache server, goroutine safe, requests are sent one by one;
+// after a read or write error the stream may be out of step, so the connection is
+// closed and the next request dials again
+type Client struct {
+	addr   string
+	lock   sync.Mutex
+	conn   net.Conn // nil after an error
+	rd     *bufio.Reader
+	closed bool
+}
+
+type Info struct {
+	Bits     int
+	Capacity int
+	Count    int
+	MaxIndex int
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr, sync.Mutex{}, conn, bufio.NewReader(conn), false}, nil
+}
+
+func (this *Client) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.closed = true
+	if this.conn == nil {
+		return nil
+	}
+
+	err := this.conn.Close()
+	this.conn = nil
+	return err
+}
+
+// drop a connection whose stream can't be trusted
+func (this *Client) reset() {
+	this.conn.Close()
+	this.conn, this.rd = nil, nil
+}
+
+// send a request and wait for the result, server errors are returned as error
+func (this *Client) call(op int, name string, args []byte) ([]byte, error) {
+	if len(name) == 0 || len(name) > MaxName {
+		return nil, ErrName
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+
+	if this.conn == nil {
+		conn, err := net.Dial("tcp", this.addr)
+		if err != nil {
+			return nil, err
+		}
+		this.conn, this.rd = conn, bufio.NewReader(conn)
+	}
+
+	if err := WriteFrame(this.conn, append(NewRequest(op, name), args...)); err != nil {
+		this.reset()
+		return nil, err
+	}
+
+	resp, err := ReadFrame(this.rd)
+	if err != nil {
+		this.reset()
+		return nil, err
+	}
+
+	if len(resp) == 0 {
+		this.reset()
+		return nil, ErrFrame
+	}
+
+	if resp[0] != StatusOK {
+		return nil, errors.New(string(resp[1:]))
+	}
+	return resp[1:], nil
+}
+
+func (this *Client) callUint64(op int, name string, args []byte) (uint64, error) {
+	resp, err := this.call(op, name, args)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) != 8 {
+		return 0, ErrFrame
+	}
+	return binary.LittleEndian.Uint64(resp), nil
+}
+
+// create a cache on the server, nothing happens if it exists with the same bits and capacity
+func (this *Client) Create(name string, bits, capa int) error {
+	_, err := this.call(OpCreate, name, binary.LittleEndian.AppendUint64([]byte{uint8(bits)}, uint64(capa)))
+	return err
+}
+
+func (this *Client) Info(name string) (*Info, error) {
+	resp, err := this.call(OpInfo, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) != 25 {
+		return nil, ErrFrame
+	}
+
+	return &Info{int(resp[0]),
+		int(binary.LittleEndian.Uint64(resp[1:])),
+		int(binary.LittleEndian.Uint64(resp[9:])),
+		int(binary.LittleEndian.Uint64(resp[17:]))}, nil
+}
+
+func (this *Client) SetLastBit(name string, index int) (bool, error) {
+	resp, err := this.call(OpSetLastBit, name, binary.LittleEndian.AppendUint64(nil, uint64(index)))
+	if err != nil {
+		return false, err
+	}
+
+	if len(resp) != 1 {
+		return false, ErrFrame
+	}
+	return resp[0] != 0, nil
+}
+
+func (this *Client) GetIndex(name string, index int) (uint64, error) {
+	return this.callUint64(OpGetIndex, name, binary.LittleEndian.AppendUint64(nil, uint64(index)))
+}
+
+func (this *Client) ResetIndex(name string, index int, value uint64) error {
+	args := binary.LittleEndian.AppendUint64(nil, uint64(index))
+	_, err := this.call(OpResetIndex, name, binary.LittleEndian.AppendUint64(args, value))
+	return err
+}
+
+func (this *Client) Count(name string) (int, error) {
+	count, err := this.callUint64(OpCount, name, nil)
+	return int(count), err
+}
+
+func (this *Client) ShiftOneBit(name string) error {
+	_, err := this.call(OpShiftOneBit, name, nil)
+	return err
+}
+
+func indexesArgs(indexes []int) []byte {
+	args := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+8*len(indexes)), uint32(len(indexes)))
+	for _, index := range indexes {
+		args = binary.LittleEndian.AppendUint64(args, uint64(index))
+	}
+	return args
+}
+
+func (this *Client) SetLastBits(name string, indexes []int) ([]bool, error) {
+	resp, err := this.call(OpSetLastBits, name, indexesArgs(indexes))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) != len(indexes) {
+		return nil, ErrFrame
+	}
+
+	res := make([]bool, len(resp))
+	for i, b := range resp {
+		res[i] = b != 0
+	}
+	return res, nil
+}
+
+func (this *Client) GetIndexes(name string, indexes []int) ([]uint64, error) {
+	resp, err := this.call(OpGetIndexes, name, indexesArgs(indexes))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) != 8*len(indexes) {
+		return nil, ErrFrame
+	}
+
+	res := make([]uint64, len(indexes))
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint64(resp[8*i:])
+	}
+	return res, nil
+}
+
+func (this *Client) ResetIndexes(name string, indexes []int, values []uint64) error {
+	if len(indexes) != len(values) {
+		return errors.New("indexes and values have different length")
+	}
+
+	args := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+16*len(indexes)), uint32(len(indexes)))
+	for i, index := range indexes {
+		args = binary.LittleEndian.AppendUint64(args, uint64(index))
+		args = binary.LittleEndian.AppendUint64(args, values[i])
+	}
+
+	_, err := this.call(OpResetIndexes, name, args)
+	return err
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+binary protocol of the bitmap cache server, all integers little endian
+
+request frame:
+	length uint32 bytes after this field
+	op     uint8
+	nlen   uint8
+	name   [nlen]byte
+	args   depend on op
+
+response frame:
+	length uint32 bytes after this field
+	status uint8  StatusOK or StatusError
+	result depend on op, an error message when status is StatusError
+
+op              args                          result
+OpCreate        bits u8, capa u64             -
+OpInfo          -                             bits u8, capa u64, count u64, max u64
+OpSetLastBit    index u64                     first time u8
+OpGetIndex      index u64                     value u64
+OpResetIndex    index u64, value u64          -
+OpCount         -                             count u64
+OpShiftOneBit   -                             -
+OpSetLastBits   n u32, n * index u64          n * first time u8
+OpGetIndexes    n u32, n * index u64          n * value u64
+OpResetIndexes  n u32, n * (index, value u64) -
+*/
+
+const (
+	OpCreate = iota + 1
+	OpInfo
+	OpSetLastBit
+	OpGetIndex
+	OpResetIndex
+	OpCount
+	OpShiftOneBit
+	OpSetLastBits
+	OpGetIndexes
+	OpResetIndexes
+)
+
+const (
+	StatusOK = iota
+	StatusError
+)
+
+const (
+	MaxFrame = 64 << 20 // biggest frame accepted by both sides
+	MaxName  = 255
+)
+
+var (
+	ErrFrameSize = errors.New("frame too large")
+	ErrFrame     = errors.New("bad frame")
+	ErrName      = errors.New("cache name must have 1 to 255 bytes")
+)
+
+// read one frame, the length field is not returned
+func ReadFrame(r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(head)
+	if size > MaxFrame {
+		return nil, ErrFrameSize
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// write body with its length field
+func WriteFrame(w io.Writer, body []byte) error {
+	if len(body) > MaxFrame {
+		return ErrFrameSize
+	}
+
+	buf := make([]byte, 4, 4+len(body))
+	binary.LittleEndian.PutUint32(buf, uint32(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// op, name and empty args of a request
+func NewRequest(op int, name string) []byte {
+	buf := make([]byte, 2, 2+len(name)+16)
+	buf[0], buf[1] = uint8(op), uint8(len(name))
+	return append(buf, name...)
+}
+
+// split a request into op, name and args
+func ParseRequest(body []byte) (int, string, []byte, error) {
+	if len(body) < 2 || len(body) < 2+int(body[1]) {
+		return 0, "", nil, ErrFrame
+	}
+
+	end := 2 + int(body[1])
+	return int(body[0]), string(body[2:end]), body[end:], nil
+}
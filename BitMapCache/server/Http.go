@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/6xiao/go/BitMapCache"
+	"github.com/6xiao/go/BitMapCache/client"
+)
+
+/*
+json http api, every response is {"result": ...} or {"error": "..."}
+
+GET  /caches                                   names of all caches
+POST /cache/<name>/create?bits=&capacity=      create a cache
+GET  /cache/<name>/info                        bits, capacity, count, max index
+POST /cache/<name>/setlastbit?index=           true if set the first time
+GET  /cache/<name>/getindex?index=             value
+POST /cache/<name>/resetindex?index=&value=    -
+GET  /cache/<name>/count                       count
+POST /cache/<name>/shiftonebit                 -
+POST /cache/<name>/setlastbits   {"indexes":[...]}                  [bool...]
+POST /cache/<name>/getindexes    {"indexes":[...]}                  [value...]
+POST /cache/<name>/resetindexes  {"indexes":[...],"values":[...]}   -
+*/
+
+var errMethod = errors.New("method not allowed")
+
+type httpResponse struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type batchBody struct {
+	Indexes []int    `json:"indexes"`
+	Values  []uint64 `json:"values"`
+}
+
+func writeJson(w http.ResponseWriter, code int, res httpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+func queryInt(r *http.Request, key string) (int, error) {
+	value, err := strconv.ParseInt(r.URL.Query().Get(key), 10, 64)
+	if err != nil {
+		return 0, errors.New("bad parameter " + key)
+	}
+	return int(value), nil
+}
+
+func queryUint64(r *http.Request, key string) (uint64, error) {
+	value, err := strconv.ParseUint(r.URL.Query().Get(key), 10, 64)
+	if err != nil {
+		return 0, errors.New("bad parameter " + key)
+	}
+	return value, nil
+}
+
+func readBatch(r *http.Request) (*batchBody, error) {
+	body := new(batchBody)
+	if err := json.NewDecoder(io.LimitReader(r.Body, client.MaxFrame)).Decode(body); err != nil {
+		return nil, errors.New("bad json body")
+	}
+	return body, nil
+}
+
+// ops that change a cache or carry a json body must be posted
+var httpWriteOps = map[string]bool{
+	"create":       true,
+	"setlastbit":   true,
+	"resetindex":   true,
+	"shiftonebit":  true,
+	"setlastbits":  true,
+	"getindexes":   true,
+	"resetindexes": true,
+}
+
+func (this *Store) serveCache(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/cache/"), "/")
+	if len(path) != 2 {
+		writeJson(w, http.StatusNotFound, httpResponse{Error: "path must be /cache/<name>/<op>"})
+		return
+	}
+
+	name, op := path[0], path[1]
+	if httpWriteOps[op] != (r.Method == http.MethodPost) {
+		writeJson(w, http.StatusMethodNotAllowed, httpResponse{Error: errMethod.Error()})
+		return
+	}
+
+	result, err := this.httpExec(r, name, op)
+	switch {
+	case err == nil:
+		writeJson(w, http.StatusOK, httpResponse{Result: result})
+	case err == errNoCache:
+		writeJson(w, http.StatusNotFound, httpResponse{Error: err.Error()})
+	default:
+		writeJson(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+	}
+}
+
+func (this *Store) httpExec(r *http.Request, name, op string) (interface{}, error) {
+	if op == "create" {
+		bits, err := queryInt(r, "bits")
+		if err != nil {
+			return nil, err
+		}
+
+		capa, err := queryInt(r, "capacity")
+		if err != nil {
+			return nil, err
+		}
+		return nil, this.Create(name, bits, capa)
+	}
+
+	// parse before locking the cache
+	var index int
+	var value uint64
+	var batch *batchBody
+	var err error
+
+	switch op {
+	case "setlastbit", "getindex":
+		index, err = queryInt(r, "index")
+
+	case "resetindex":
+		if index, err = queryInt(r, "index"); err == nil {
+			value, err = queryUint64(r, "value")
+		}
+
+	case "setlastbits", "getindexes", "resetindexes":
+		batch, err = readBatch(r)
+		if err == nil && op == "resetindexes" && len(batch.Indexes) != len(batch.Values) {
+			err = errors.New("indexes and values have different length")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = this.With(name, func(c BitMapCache.Cache) error {
+		switch op {
+		case "info":
+			result = map[string]int{
+				"bits":     c.Bits(),
+				"capacity": c.Capacity(),
+				"count":    c.Count(),
+				"maxindex": c.MaxIndex(),
+			}
+
+		case "setlastbit":
+			result = c.SetLastBit(index)
+
+		case "getindex":
+			result = c.GetIndex(index)
+
+		case "resetindex":
+			c.ResetIndex(index, value)
+
+		case "count":
+			result = c.Count()
+
+		case "shiftonebit":
+			c.ShiftOneBit()
+
+		case "setlastbits":
+			res := make([]bool, len(batch.Indexes))
+			for i, index := range batch.Indexes {
+				res[i] = c.SetLastBit(index)
+			}
+			result = res
+
+		case "getindexes":
+			res := make([]uint64, len(batch.Indexes))
+			for i, index := range batch.Indexes {
+				res[i] = c.GetIndex(index)
+			}
+			result = res
+
+		case "resetindexes":
+			for i, index := range batch.Indexes {
+				c.ResetIndex(index, batch.Values[i])
+			}
+
+		default:
+			return errUnknown
+		}
+		return nil
+	})
+	return result, err
+}
+
+func ListenHttp(addr string, store *Store) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/caches", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, httpResponse{Result: store.Names()})
+	})
+	mux.HandleFunc("/cache/", store.serveCache)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/6xiao/go/BitMapCache"
+	"github.com/6xiao/go/BitMapCache/client"
+	"github.com/6xiao/go/Common"
+)
+
+var (
+	flgAddr     = flag.String("addr", "127.0.0.1:5382", "binary protocol addr")
+	flgHttp     = flag.String("http", "127.0.0.1:5383", "json http api addr, empty to disable")
+	flgDir      = flag.String("dir", "", "snapshot directory, empty to disable")
+	flgInterval = flag.Duration("interval", 5*time.Minute, "snapshot interval")
+	flgCaches   = flag.String("caches", "", "caches to create, name:bits:capacity,...")
+	flgMaxCapa  = flag.Int("maxcapa", 1<<33, "max capacity of a cache")
+)
+
+const snapshotExt = ".bmc"
+
+var (
+	errNoCache  = errors.New("no such cache")
+	errCacheDef = errors.New("cache exists with other bits or capacity")
+	errBadName  = errors.New("cache name must match [A-Za-z0-9_-][A-Za-z0-9_.-]*")
+	errBadCache = errors.New("bits must be 1-64 and capacity 1-maxcapa")
+	errUnknown  = errors.New("unknown op")
+
+	nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+)
+
+type namedCache struct {
+	sync.Mutex
+	cache BitMapCache.Cache
+}
+
+// named caches of any width
+type Store struct {
+	lock   sync.RWMutex
+	dir    string
+	caches map[string]*namedCache
+}
+
+func NewStore(dir string) *Store {
+	return &Store{sync.RWMutex{}, dir, make(map[string]*namedCache)}
+}
+
+func (this *Store) Create(name string, bits, capa int) error {
+	if len(name) > client.MaxName || !nameRegexp.MatchString(name) {
+		return errBadName
+	}
+
+	if capa <= 0 || capa > *flgMaxCapa {
+		return errBadCache
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if nc, ok := this.caches[name]; ok {
+		if nc.cache.Bits() != bits || nc.cache.Capacity() != capa {
+			return errCacheDef
+		}
+		return nil
+	}
+
+	cache := BitMapCache.NewHistoryCache(bits, capa)
+	if cache == nil {
+		return errBadCache
+	}
+
+	this.caches[name] = &namedCache{sync.Mutex{}, cache}
+	return nil
+}
+
+func (this *Store) Names() []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	names := make([]string, 0, len(this.caches))
+	for name := range this.caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run fn with the cache locked
+func (this *Store) With(name string, fn func(c BitMapCache.Cache) error) error {
+	this.lock.RLock()
+	nc, ok := this.caches[name]
+	this.lock.RUnlock()
+
+	if !ok {
+		return errNoCache
+	}
+
+	nc.Lock()
+	defer nc.Unlock()
+	return fn(nc.cache)
+}
+
+// load every snapshot in the directory
+func (this *Store) Load() error {
+	if this.dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(this.dir, "*"+snapshotExt))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		cache, err := BitMapCache.LoadCache(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("load %v : %v", file, err)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), snapshotExt)
+		this.lock.Lock()
+		this.caches[name] = &namedCache{sync.Mutex{}, cache}
+		this.lock.Unlock()
+		log.Println("load", name, "bits", cache.Bits(), "capacity", cache.Capacity(), "count", cache.Count())
+	}
+	return nil
+}
+
+func (this *Store) saveOne(name string, c BitMapCache.Cache) error {
+	file := filepath.Join(this.dir, name+snapshotExt)
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	wt := bufio.NewWriter(f)
+	err = BitMapCache.SaveCache(wt, c)
+	if err == nil {
+		err = wt.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// write every cache to the directory, a cache is locked while it's written
+func (this *Store) Snapshot() error {
+	if this.dir == "" {
+		return nil
+	}
+
+	for _, name := range this.Names() {
+		err := this.With(name, func(c BitMapCache.Cache) error {
+			return this.saveOne(name, c)
+		})
+		if err != nil {
+			return fmt.Errorf("snapshot %v : %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (this *Store) AutoSnapshot(interval time.Duration) {
+	defer Common.CheckPanic()
+
+	for range time.Tick(interval) {
+		if err := this.Snapshot(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// indexes of a batch request: n u32, n * index u64, each followed by extra bytes
+func batchArgs(args []byte, extra int) (int, error) {
+	if len(args) < 4 {
+		return 0, client.ErrFrame
+	}
+
+	n := int(binary.LittleEndian.Uint32(args))
+	if len(args) != 4+n*(8+extra) {
+		return 0, client.ErrFrame
+	}
+	return n, nil
+}
+
+// run a binary request, return the result
+func (this *Store) Exec(req []byte) ([]byte, error) {
+	op, name, args, err := client.ParseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	if op == client.OpCreate {
+		if len(args) != 9 {
+			return nil, client.ErrFrame
+		}
+		return nil, this.Create(name, int(args[0]), int(le.Uint64(args[1:])))
+	}
+
+	var res []byte
+	err = this.With(name, func(c BitMapCache.Cache) error {
+		switch op {
+		case client.OpInfo:
+			res = append(res, uint8(c.Bits()))
+			res = le.AppendUint64(res, uint64(c.Capacity()))
+			res = le.AppendUint64(res, uint64(c.Count()))
+			res = le.AppendUint64(res, uint64(c.MaxIndex()))
+
+		case client.OpSetLastBit:
+			if len(args) != 8 {
+				return client.ErrFrame
+			}
+
+			res = []byte{0}
+			if c.SetLastBit(int(le.Uint64(args))) {
+				res[0] = 1
+			}
+
+		case client.OpGetIndex:
+			if len(args) != 8 {
+				return client.ErrFrame
+			}
+			res = le.AppendUint64(res, c.GetIndex(int(le.Uint64(args))))
+
+		case client.OpResetIndex:
+			if len(args) != 16 {
+				return client.ErrFrame
+			}
+			c.ResetIndex(int(le.Uint64(args)), le.Uint64(args[8:]))
+
+		case client.OpCount:
+			res = le.AppendUint64(res, uint64(c.Count()))
+
+		case client.OpShiftOneBit:
+			c.ShiftOneBit()
+
+		case client.OpSetLastBits:
+			n, err := batchArgs(args, 0)
+			if err != nil {
+				return err
+			}
+
+			res = make([]byte, n)
+			for i := range res {
+				if c.SetLastBit(int(le.Uint64(args[4+8*i:]))) {
+					res[i] = 1
+				}
+			}
+
+		case client.OpGetIndexes:
+			n, err := batchArgs(args, 0)
+			if err != nil {
+				return err
+			}
+
+			res = make([]byte, 0, 8*n)
+			for i := 0; i < n; i++ {
+				res = le.AppendUint64(res, c.GetIndex(int(le.Uint64(args[4+8*i:]))))
+			}
+
+		case client.OpResetIndexes:
+			n, err := batchArgs(args, 8)
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < n; i++ {
+				c.ResetIndex(int(le.Uint64(args[4+16*i:])), le.Uint64(args[12+16*i:]))
+			}
+
+		default:
+			return errUnknown
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (this *Store) Reactiver(conn net.Conn) {
+	defer Common.CheckPanic()
+	defer conn.Close()
+
+	rd, wt := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		req, err := client.ReadFrame(rd)
+		if err != nil {
+			if err != io.EOF {
+				log.Println(conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		res, err := this.Exec(req)
+		if err != nil {
+			res = append([]byte{client.StatusError}, err.Error()...)
+		} else {
+			res = append([]byte{client.StatusOK}, res...)
+		}
+
+		if err := client.WriteFrame(wt, res); err != nil {
+			return
+		}
+
+		// flush when no pipelined request is waiting
+		if rd.Buffered() == 0 {
+			if err := wt.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// name:bits:capacity,...
+func (this *Store) createFlags(defs string) error {
+	for _, def := range strings.Split(defs, ",") {
+		if def = strings.TrimSpace(def); def == "" {
+			continue
+		}
+
+		fields := strings.Split(def, ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("bad cache define : %v", def)
+		}
+
+		bits, err1 := strconv.Atoi(fields[1])
+		capa, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("bad cache define : %v", def)
+		}
+
+		if err := this.Create(fields[0], bits, capa); err != nil {
+			return fmt.Errorf("create %v : %v", def, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	Common.Init(nil)
+
+	store := NewStore(*flgDir)
+	if err := store.Load(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := store.createFlags(*flgCaches); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *flgHttp != "" {
+		go func() {
+			log.Println(ListenHttp(*flgHttp, store))
+		}()
+	}
+
+	if *flgDir != "" && *flgInterval > 0 {
+		go store.AutoSnapshot(*flgInterval)
+	}
+
+	go func() {
+		log.Println(Common.ListenSocket(*flgAddr, true, store.Reactiver))
+	}()
+
+	<-Common.QuitSignal()
+	if err := store.Snapshot(); err != nil {
+		log.Println(err)
+	}
+}
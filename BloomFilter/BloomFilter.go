@@ -4,14 +4,27 @@ import (
 	"github.com/6xiao/go/BitMapCache"
 )
 
+// filters made by NewBloomFilter hash with the keys (djb2 seeded by every key),
+// filters made by NewBloomFilterFor use k murmur3 double hashes
 type BloomFilter struct {
 	haskKey []uint64
 	mod     uint64
-	cache   *BitMapCache.Bit1Cache
+	cache   BitSet
+	k       int
 }
 
-func NewBloomFilter(keys []uint64, cache *BitMapCache.Bit1Cache) *BloomFilter {
-	return &BloomFilter{keys, uint64(cache.Capacity()), cache}
+// bits of a filter: a BitMapCache.Bit1Cache, or a 1 bit AtomicCache or MmapCache
+type BitSet interface {
+	BitMapCache.Cache
+	NextSet(from int) int
+}
+
+// nil if cache isn't 1 bit wide
+func NewBloomFilter(keys []uint64, cache BitSet) *BloomFilter {
+	if cache.Bits() != 1 {
+		return nil
+	}
+	return &BloomFilter{keys, uint64(cache.Capacity()), cache, 0}
 }
 
 func NewDefaultBloomFilter() *BloomFilter {
@@ -19,11 +32,37 @@ func NewDefaultBloomFilter() *BloomFilter {
 	return NewBloomFilter(primes, BitMapCache.NewBit1Cache(1<<32))
 }
 
+// sized for expectedItems at falsePositiveRate, nil if the arguments are invalid
+func NewBloomFilterFor(expectedItems int, falsePositiveRate float64) *BloomFilter {
+	m, k := optimalSize(expectedItems, falsePositiveRate)
+	if m <= 0 {
+		return nil
+	}
+
+	return &BloomFilter{nil, uint64(m), BitMapCache.NewBit1Cache(m), k}
+}
+
 func (this *BloomFilter) Keys() []uint64 {
 	return this.haskKey
 }
 
+// number of hash functions
+func (this *BloomFilter) K() int {
+	if this.k > 0 {
+		return this.k
+	}
+	return len(this.haskKey)
+}
+
 func (this *BloomFilter) Set(data []byte) {
+	if this.k > 0 {
+		pos := newPositions(data, this.mod)
+		for i := 0; i < this.k; i++ {
+			this.cache.SetLastBit(pos.at(i))
+		}
+		return
+	}
+
 	for _, key := range this.haskKey {
 		hash := key
 		for _, b := range data {
@@ -35,6 +74,14 @@ func (this *BloomFilter) Set(data []byte) {
 
 func (this *BloomFilter) Hits(data []byte) int {
 	res := uint64(0)
+	if this.k > 0 {
+		pos := newPositions(data, this.mod)
+		for i := 0; i < this.k; i++ {
+			res += this.cache.GetIndex(pos.at(i))
+		}
+		return int(res)
+	}
+
 	for _, key := range this.haskKey {
 		hash := key
 		for _, b := range data {
@@ -46,5 +93,20 @@ func (this *BloomFilter) Hits(data []byte) int {
 }
 
 func (this *BloomFilter) IsSet(data []byte) bool {
-	return this.Hits(data) == len(this.haskKey)
+	return this.Hits(data) == this.K()
+}
+
+// ratio of the bits set
+func (this *BloomFilter) fill() float64 {
+	return float64(this.cache.Count()) / float64(this.mod)
+}
+
+// false positive rate at the current fill ratio
+func (this *BloomFilter) EstimatedFalsePositiveRate() float64 {
+	return fillRate(this.fill(), this.K())
+}
+
+// estimated number of distinct items set
+func (this *BloomFilter) ApproxCount() int {
+	return estimateCount(this.cache.Count(), int(this.mod), this.K())
 }
@@ -0,0 +1,78 @@
+package BloomFilter
+
+import (
+	"sync"
+
+	"github.com/6xiao/go/BitMapCache"
+)
+
+// locks serializing TestAndSet of the same item
+const testAndSetLocks = 64
+
+// goroutine safe bloom filter, bits are set with CAS on 64-bit words
+// (BitMapCache.AtomicCache), so concurrent Set never loses a bit
+type ConcurrentBloomFilter struct {
+	mod   uint64
+	k     int
+	cache *BitMapCache.AtomicCache
+	locks [testAndSetLocks]sync.Mutex
+}
+
+// sized for expectedItems at falsePositiveRate, nil if the arguments are invalid
+func NewConcurrentBloomFilter(expectedItems int, falsePositiveRate float64) *ConcurrentBloomFilter {
+	m, k := optimalSize(expectedItems, falsePositiveRate)
+	if m <= 0 {
+		return nil
+	}
+
+	return &ConcurrentBloomFilter{mod: uint64(m), k: k, cache: BitMapCache.NewAtomicCache(1, m)}
+}
+
+func (this *ConcurrentBloomFilter) K() int {
+	return this.k
+}
+
+func (this *ConcurrentBloomFilter) Set(data []byte) {
+	pos := newPositions(data, this.mod)
+	for i := 0; i < this.k; i++ {
+		this.cache.SetLastBit(pos.at(i))
+	}
+}
+
+func (this *ConcurrentBloomFilter) IsSet(data []byte) bool {
+	pos := newPositions(data, this.mod)
+	for i := 0; i < this.k; i++ {
+		if this.cache.GetIndex(pos.at(i)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// set the item, true if it was present before. calls with the same item
+// are serialized, so only one of them reports it as new
+func (this *ConcurrentBloomFilter) TestAndSet(data []byte) bool {
+	pos := newPositions(data, this.mod)
+
+	lock := &this.locks[pos.h1%testAndSetLocks]
+	lock.Lock()
+	defer lock.Unlock()
+
+	present := true
+	for i := 0; i < this.k; i++ {
+		if this.cache.SetLastBit(pos.at(i)) {
+			present = false
+		}
+	}
+	return present
+}
+
+// false positive rate at the current fill ratio
+func (this *ConcurrentBloomFilter) EstimatedFalsePositiveRate() float64 {
+	return fillRate(float64(this.cache.Count())/float64(this.mod), this.k)
+}
+
+// estimated number of distinct items set
+func (this *ConcurrentBloomFilter) ApproxCount() int {
+	return estimateCount(this.cache.Count(), int(this.mod), this.k)
+}
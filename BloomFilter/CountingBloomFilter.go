@@ -0,0 +1,79 @@
+package BloomFilter
+
+import (
+	"github.com/6xiao/go/BitMapCache"
+)
+
+// bloom filter with 4-bit counters, items can be removed.
+// a counter that reaches 15 sticks there: it's never decremented again,
+// so removing other items never makes a present item disappear
+type CountingBloomFilter struct {
+	mod       uint64
+	k         int
+	cache     *BitMapCache.Bit4Cache
+	overflows int
+}
+
+// sized for expectedItems at falsePositiveRate, nil if the arguments are invalid
+func NewCountingBloomFilter(expectedItems int, falsePositiveRate float64) *CountingBloomFilter {
+	m, k := optimalSize(expectedItems, falsePositiveRate)
+	if m <= 0 {
+		return nil
+	}
+
+	return &CountingBloomFilter{uint64(m), k, BitMapCache.NewBit4Cache(m), 0}
+}
+
+func (this *CountingBloomFilter) K() int {
+	return this.k
+}
+
+// counters stuck at the max value
+func (this *CountingBloomFilter) Overflows() int {
+	return this.overflows
+}
+
+func (this *CountingBloomFilter) Add(data []byte) {
+	pos := newPositions(data, this.mod)
+	for i := 0; i < this.k; i++ {
+		// counted once, when the counter reaches the max
+		if value, ok := this.cache.Incr(pos.at(i), 1); ok && value == 0xF {
+			this.overflows++
+		}
+	}
+}
+
+// remove an item added before, false if it isn't in the filter
+func (this *CountingBloomFilter) Remove(data []byte) bool {
+	if !this.Contains(data) {
+		return false
+	}
+
+	pos := newPositions(data, this.mod)
+	for i := 0; i < this.k; i++ {
+		if index := pos.at(i); this.cache.GetIndex(index) != 0xF {
+			this.cache.Decr(index, 1)
+		}
+	}
+	return true
+}
+
+func (this *CountingBloomFilter) Contains(data []byte) bool {
+	pos := newPositions(data, this.mod)
+	for i := 0; i < this.k; i++ {
+		if this.cache.GetIndex(pos.at(i)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// false positive rate at the current fill ratio
+func (this *CountingBloomFilter) EstimatedFalsePositiveRate() float64 {
+	return fillRate(float64(this.cache.Count())/float64(this.mod), this.k)
+}
+
+// estimated number of distinct items in the filter
+func (this *CountingBloomFilter) ApproxCount() int {
+	return estimateCount(this.cache.Count(), int(this.mod), this.k)
+}
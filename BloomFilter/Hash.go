@@ -0,0 +1,55 @@
+package BloomFilter
+
+import (
+	"math"
+
+	"github.com/6xiao/go/Common"
+)
+
+// bit positions of an item by double hashing over murmur3 128: h1 + i*h2,
+// shared by every filter of the package
+type positions struct {
+	h1, h2, mod uint64
+}
+
+func newPositions(data []byte, mod uint64) positions {
+	h1, h2 := Common.Murmur3(data, 0)
+
+	// all k probes would hit one bit, any other step keeps the positions
+	// of the other items, so filters saved before stay valid
+	if mod > 1 && h2%mod == 0 {
+		h2++
+	}
+	return positions{h1, h2, mod}
+}
+
+func (this positions) at(i int) int {
+	return int((this.h1 + uint64(i)*this.h2) % this.mod)
+}
+
+// bits and hashes for n items at false positive rate p, zeros if invalid
+func optimalSize(n int, p float64) (int, int) {
+	if n <= 0 || p <= 0 || p >= 1 {
+		return 0, 0
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return int(m), k
+}
+
+// false positive rate of k hashes when a fill ratio of the bits are set
+func fillRate(fill float64, k int) float64 {
+	return math.Pow(fill, float64(k))
+}
+
+// items added to m bits with k hashes when x bits are set
+func estimateCount(x, m, k int) int {
+	if x >= m {
+		return m
+	}
+	return int(math.Round(-float64(m) / float64(k) * math.Log(1-float64(x)/float64(m))))
+}
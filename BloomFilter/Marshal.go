@@ -0,0 +1,138 @@
+package BloomFilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/6xiao/go/BitMapCache"
+)
+
+/*
+BloomFilter binary layout, all fields little endian:
+
+	0  magic uint32 "BLMF"
+	4  k     uint32 murmur3 hashes, 0 for keyed filters
+	8  mod   uint64 bits
+	16 nkeys uint32
+	20 keys  [nkeys]uint64
+	.. cache snapshot written by BitMapCache.SaveCache
+*/
+
+const (
+	marshalMagic   = 0x464d4c42
+	marshalHeadLen = 20
+)
+
+var (
+	ErrFilterFormat       = errors.New("bad bloom filter data")
+	ErrFilterIncompatible = errors.New("bloom filters have different size or hashes")
+)
+
+func (this *BloomFilter) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, marshalHeadLen+8*len(this.haskKey)+int(this.mod/8)+64))
+
+	head := make([]byte, marshalHeadLen)
+	binary.LittleEndian.PutUint32(head[0:], marshalMagic)
+	binary.LittleEndian.PutUint32(head[4:], uint32(this.k))
+	binary.LittleEndian.PutUint64(head[8:], this.mod)
+	binary.LittleEndian.PutUint32(head[16:], uint32(len(this.haskKey)))
+	buf.Write(head)
+
+	for _, key := range this.haskKey {
+		binary.Write(buf, binary.LittleEndian, key)
+	}
+
+	if err := BitMapCache.SaveCache(buf, this.cache); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < marshalHeadLen || binary.LittleEndian.Uint32(data) != marshalMagic {
+		return ErrFilterFormat
+	}
+
+	k := int(binary.LittleEndian.Uint32(data[4:]))
+	mod := binary.LittleEndian.Uint64(data[8:])
+	nkeys := int(binary.LittleEndian.Uint32(data[16:]))
+	if len(data) < marshalHeadLen+8*nkeys || (k == 0) == (nkeys == 0) {
+		return ErrFilterFormat
+	}
+
+	keys := make([]uint64, nkeys)
+	for i := range keys {
+		keys[i] = binary.LittleEndian.Uint64(data[marshalHeadLen+8*i:])
+	}
+
+	c, err := BitMapCache.LoadCache(bytes.NewReader(data[marshalHeadLen+8*nkeys:]))
+	if err != nil {
+		return err
+	}
+
+	cache, ok := c.(BitSet)
+	if !ok || cache.Bits() != 1 || uint64(cache.Capacity()) != mod {
+		return ErrFilterFormat
+	}
+
+	if nkeys == 0 {
+		keys = nil
+	}
+
+	this.haskKey, this.mod, this.cache, this.k = keys, mod, cache, k
+	return nil
+}
+
+// same size and hash functions
+func (this *BloomFilter) Compatible(other *BloomFilter) bool {
+	if this.mod != other.mod || this.k != other.k || len(this.haskKey) != len(other.haskKey) {
+		return false
+	}
+
+	for i, key := range this.haskKey {
+		if other.haskKey[i] != key {
+			return false
+		}
+	}
+	return true
+}
+
+// this contains the items of both filters
+func (this *BloomFilter) Union(other *BloomFilter) error {
+	if !this.Compatible(other) {
+		return ErrFilterIncompatible
+	}
+
+	a, ok1 := this.cache.(*BitMapCache.Bit1Cache)
+	b, ok2 := other.cache.(*BitMapCache.Bit1Cache)
+	if ok1 && ok2 {
+		return a.Or(b)
+	}
+
+	for i := other.cache.NextSet(0); i >= 0; i = other.cache.NextSet(i + 1) {
+		this.cache.SetLastBit(i)
+	}
+	return nil
+}
+
+// this contains the items set in both filters, its false positive rate
+// may be higher than a filter built from the common items
+func (this *BloomFilter) Intersect(other *BloomFilter) error {
+	if !this.Compatible(other) {
+		return ErrFilterIncompatible
+	}
+
+	a, ok1 := this.cache.(*BitMapCache.Bit1Cache)
+	b, ok2 := other.cache.(*BitMapCache.Bit1Cache)
+	if ok1 && ok2 {
+		return a.And(b)
+	}
+
+	for i := this.cache.NextSet(0); i >= 0; i = this.cache.NextSet(i + 1) {
+		if other.cache.GetIndex(i) == 0 {
+			this.cache.ResetIndex(i, 0)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package BloomFilter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/6xiao/go/BitMapCache"
+)
+
+// bloom filter over a sliding window of generations, goroutine safe.
+// every bit position is a shift register (BitMapCache.HistoryCache):
+// Add sets bit 0, Rotate shifts every register one bit so items added
+// more than generations rotations ago expire
+type RotatingBloomFilter struct {
+	lock        sync.RWMutex
+	mod         uint64
+	k           int
+	generations int
+	cache       *BitMapCache.HistoryCache
+}
+
+// itemsPerGeneration items are expected between two rotations,
+// generations is 1-64, nil if the arguments are invalid
+func NewRotatingBloomFilter(itemsPerGeneration, generations int, falsePositiveRate float64) *RotatingBloomFilter {
+	if generations <= 0 || generations > 64 {
+		return nil
+	}
+
+	m, k := optimalSize(itemsPerGeneration*generations, falsePositiveRate)
+	if m <= 0 {
+		return nil
+	}
+
+	return &RotatingBloomFilter{sync.RWMutex{}, uint64(m), k, generations, BitMapCache.NewHistoryCache(generations, m)}
+}
+
+func (this *RotatingBloomFilter) K() int {
+	return this.k
+}
+
+func (this *RotatingBloomFilter) Generations() int {
+	return this.generations
+}
+
+// add to the current generation
+func (this *RotatingBloomFilter) Add(data []byte) {
+	pos := newPositions(data, this.mod)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i := 0; i < this.k; i++ {
+		this.cache.SetLastBit(pos.at(i))
+	}
+}
+
+// added in the last generations, the current one included
+func (this *RotatingBloomFilter) SeenWithin(data []byte, generations int) bool {
+	if generations <= 0 {
+		return false
+	}
+
+	mask := ^uint64(0)
+	if generations < 64 {
+		mask = 1<<uint(generations) - 1
+	}
+
+	pos := newPositions(data, this.mod)
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for i := 0; i < this.k; i++ {
+		if this.cache.GetIndex(pos.at(i))&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// added in any generation kept
+func (this *RotatingBloomFilter) IsSet(data []byte) bool {
+	return this.SeenWithin(data, this.generations)
+}
+
+// start a new generation, the oldest expires
+func (this *RotatingBloomFilter) Rotate() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cache.ShiftOneBit()
+}
+
+// scheduler calling Rotate every period, eg: a 10 minutes window is
+// 10 generations rotated every minute; call Start on it
+func (this *RotatingBloomFilter) Scheduler(period time.Duration, loc *time.Location) *BitMapCache.ShiftScheduler {
+	return BitMapCache.NewShiftScheduler(this.cache, period, loc, &this.lock)
+}
@@ -0,0 +1,74 @@
+package BloomFilter
+
+const (
+	scalableGrowth  = 2   // every layer expects this times the items of the one before
+	scalableTighten = 0.9 // and has this times its false positive rate
+	scalableMaxFill = 0.5 // a layer is full when this ratio of its bits are set
+)
+
+// bloom filter that grows: when the last layer is full a larger, tighter
+// layer is appended, the false positive rates of the layers add up to
+// at most falsePositiveRate (a geometric series)
+type ScalableBloomFilter struct {
+	layers []*BloomFilter
+	items  int     // expected items of the last layer
+	rate   float64 // false positive rate of the last layer
+}
+
+// nil if the arguments are invalid
+func NewScalableBloomFilter(initialItems int, falsePositiveRate float64) *ScalableBloomFilter {
+	rate := falsePositiveRate * (1 - scalableTighten)
+	first := NewBloomFilterFor(initialItems, rate)
+	if first == nil {
+		return nil
+	}
+
+	return &ScalableBloomFilter{[]*BloomFilter{first}, initialItems, rate}
+}
+
+func (this *ScalableBloomFilter) Layers() int {
+	return len(this.layers)
+}
+
+func (this *ScalableBloomFilter) Set(data []byte) {
+	if this.IsSet(data) {
+		return
+	}
+
+	last := this.layers[len(this.layers)-1]
+	if last.fill() >= scalableMaxFill {
+		this.items *= scalableGrowth
+		this.rate *= scalableTighten
+		last = NewBloomFilterFor(this.items, this.rate)
+		this.layers = append(this.layers, last)
+	}
+
+	last.Set(data)
+}
+
+func (this *ScalableBloomFilter) IsSet(data []byte) bool {
+	for i := len(this.layers) - 1; i >= 0; i-- {
+		if this.layers[i].IsSet(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// false positive rate of all layers at their current fill ratio
+func (this *ScalableBloomFilter) EstimatedFalsePositiveRate() float64 {
+	miss := 1.0
+	for _, layer := range this.layers {
+		miss *= 1 - layer.EstimatedFalsePositiveRate()
+	}
+	return 1 - miss
+}
+
+// estimated number of distinct items set
+func (this *ScalableBloomFilter) ApproxCount() int {
+	count := 0
+	for _, layer := range this.layers {
+		count += layer.ApproxCount()
+	}
+	return count
+}
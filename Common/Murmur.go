@@ -0,0 +1,90 @@
+package Common
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	murmurC1 = 0x87c37b91114253d5
+	murmurC2 = 0x4cf5ad432745937f
+)
+
+func murmurMix(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// hash : []byte to 128 bits, MurmurHash3 x64_128
+func Murmur3(mem []byte, seed uint64) (uint64, uint64) {
+	h1, h2 := seed, seed
+	n := len(mem)
+
+	for ; len(mem) >= 16; mem = mem[16:] {
+		k1 := binary.LittleEndian.Uint64(mem)
+		k2 := binary.LittleEndian.Uint64(mem[8:])
+
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	// tail, little endian bytes
+	var k1, k2 uint64
+	for i := len(mem) - 1; i >= 8; i-- {
+		k2 = k2<<8 | uint64(mem[i])
+	}
+	last := len(mem) - 1
+	if last > 7 {
+		last = 7
+	}
+	for i := last; i >= 0; i-- {
+		k1 = k1<<8 | uint64(mem[i])
+	}
+
+	if len(mem) > 8 {
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+	}
+
+	if len(mem) > 0 {
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+
+	h1 += h2
+	h2 += h1
+
+	h1 = murmurMix(h1)
+	h2 = murmurMix(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return h1, h2
+}
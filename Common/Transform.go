@@ -17,6 +17,13 @@ func Hash(mem []byte) uint64 {
 	return hash
 }
 
+// hash : []byte to uint64, the first half of Murmur3 seeded 0;
+// unlike Hash, inputs that collide in djb2 don't collide here
+func Hash64(mem []byte) uint64 {
+	h1, _ := Murmur3(mem, 0)
+	return h1
+}
+
 // compress data use gzip
 func Gzip(in []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
@@ -0,0 +1,269 @@
+package CuckooFilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+
+	"github.com/6xiao/go/BitMapCache"
+	"github.com/6xiao/go/Common"
+)
+
+/*
+cuckoo filter: every item has a fingerprint stored in one of two buckets,
+i1 = hash(item) and i2 = i1 ^ hash(fingerprint), so an item can be deleted
+and either bucket is found from the other. fingerprints are packed in a
+BitMapCache.HistoryCache, slot bucket*bucketSize+j, 0 is an empty slot.
+
+saved layout, all fields little endian:
+
+	0  magic      uint32 "CKOF"
+	4  version    uint16
+	6  fpbits     uint8
+	7  bucketSize uint8
+	8  buckets    uint64
+	16 count      uint64
+	24 victim     uint64 bucket of the stashed fingerprint
+	32 victimFp   uint64 stashed fingerprint, 0 if none
+	40 -          uint32 reserved
+	44 crc        uint32 crc32(IEEE) of byte 0-43
+	48 fingerprints, a BitMapCache snapshot
+*/
+
+const (
+	saveMagic   = 0x464f4b43
+	saveVersion = 1
+	saveHeadLen = 48
+
+	maxKicks   = 500
+	loadFactor = 0.95 // expected load of a full filter
+)
+
+var (
+	ErrFormat   = errors.New("not a cuckoo filter")
+	ErrVersion  = errors.New("unknown cuckoo filter version")
+	ErrChecksum = errors.New("cuckoo filter checksum mismatch")
+)
+
+type CuckooFilter struct {
+	fpbits     int
+	bucketSize int
+	mask       uint64 // buckets - 1
+	count      int
+	victim     int    // bucket of victimFp
+	victimFp   uint64 // fingerprint kicked out when the filter was full
+	slots      *BitMapCache.HistoryCache
+}
+
+// room for capacity items, fingerprintBits is 1-32, bucketSize is 1-255,
+// nil if the arguments are invalid; eg: 16 bits and 4 per bucket give
+// a false positive rate about 2*4/65536
+func NewCuckooFilter(capacity, fingerprintBits, bucketSize int) *CuckooFilter {
+	if capacity <= 0 || fingerprintBits <= 0 || fingerprintBits > 32 || bucketSize <= 0 || bucketSize > 255 {
+		return nil
+	}
+
+	// buckets must be a power of 2 for the xor of i2
+	need, buckets := int(float64(capacity)/loadFactor/float64(bucketSize))+1, 1
+	for buckets < need {
+		buckets <<= 1
+	}
+
+	return newFilter(fingerprintBits, bucketSize, buckets)
+}
+
+func newFilter(fpbits, bucketSize, buckets int) *CuckooFilter {
+	slots := BitMapCache.NewHistoryCache(fpbits, buckets*bucketSize)
+	if slots == nil {
+		return nil
+	}
+	return &CuckooFilter{fpbits, bucketSize, uint64(buckets - 1), 0, 0, 0, slots}
+}
+
+// bucket and fingerprint != 0 of an item
+func (this *CuckooFilter) locate(data []byte) (int, uint64) {
+	h1, h2 := Common.Murmur3(data, 0)
+	fp := h2 & (1<<uint(this.fpbits) - 1)
+	if fp == 0 {
+		fp = 1
+	}
+	return int(h1 & this.mask), fp
+}
+
+func (this *CuckooFilter) alt(bucket int, fp uint64) int {
+	return int((uint64(bucket) ^ fp*0x5bd1e995) & this.mask)
+}
+
+// slot of fp in the bucket, -1 if not found
+func (this *CuckooFilter) find(bucket int, fp uint64) int {
+	for j := 0; j < this.bucketSize; j++ {
+		if slot := bucket*this.bucketSize + j; this.slots.GetIndex(slot) == fp {
+			return slot
+		}
+	}
+	return -1
+}
+
+func (this *CuckooFilter) put(bucket int, fp uint64) bool {
+	if slot := this.find(bucket, 0); slot >= 0 {
+		this.slots.ResetIndex(slot, fp)
+		return true
+	}
+	return false
+}
+
+// false if the filter is full, the item isn't added then
+func (this *CuckooFilter) Insert(data []byte) bool {
+	if this.victimFp != 0 {
+		return false
+	}
+
+	i1, fp := this.locate(data)
+	this.count++
+	if this.put(i1, fp) || this.put(this.alt(i1, fp), fp) {
+		return true
+	}
+
+	// kick a random fingerprint to its other bucket
+	bucket := i1
+	if rand.Intn(2) == 0 {
+		bucket = this.alt(i1, fp)
+	}
+
+	for n := 0; n < maxKicks; n++ {
+		slot := bucket*this.bucketSize + rand.Intn(this.bucketSize)
+		kicked := this.slots.GetIndex(slot)
+		this.slots.ResetIndex(slot, fp)
+
+		fp, bucket = kicked, this.alt(bucket, kicked)
+		if this.put(bucket, fp) {
+			return true
+		}
+	}
+
+	// the item is in, the last kicked one waits in the stash
+	this.victim, this.victimFp = bucket, fp
+	return true
+}
+
+func (this *CuckooFilter) Lookup(data []byte) bool {
+	i1, fp := this.locate(data)
+	i2 := this.alt(i1, fp)
+	if this.victimFp == fp && (this.victim == i1 || this.victim == i2) {
+		return true
+	}
+	return this.find(i1, fp) >= 0 || this.find(i2, fp) >= 0
+}
+
+// delete an item inserted before, false if it isn't found;
+// deleting an item never inserted may delete another one
+func (this *CuckooFilter) Delete(data []byte) bool {
+	i1, fp := this.locate(data)
+	i2 := this.alt(i1, fp)
+
+	if this.victimFp == fp && (this.victim == i1 || this.victim == i2) {
+		this.victimFp = 0
+		this.count--
+		return true
+	}
+
+	for _, bucket := range []int{i1, i2} {
+		if slot := this.find(bucket, fp); slot >= 0 {
+			this.slots.ResetIndex(slot, 0)
+			this.count--
+			this.restash()
+			return true
+		}
+	}
+	return false
+}
+
+// move the stashed fingerprint back after a slot was freed
+func (this *CuckooFilter) restash() {
+	if this.victimFp == 0 {
+		return
+	}
+
+	if this.put(this.victim, this.victimFp) || this.put(this.alt(this.victim, this.victimFp), this.victimFp) {
+		this.victimFp = 0
+	}
+}
+
+// number of items in the filter
+func (this *CuckooFilter) Count() int {
+	return this.count
+}
+
+func (this *CuckooFilter) Capacity() int {
+	return int(this.mask+1) * this.bucketSize
+}
+
+func (this *CuckooFilter) FingerprintBits() int {
+	return this.fpbits
+}
+
+func (this *CuckooFilter) BucketSize() int {
+	return this.bucketSize
+}
+
+// write the filter, see the layout above
+func (this *CuckooFilter) Save(w io.Writer) error {
+	buf := make([]byte, saveHeadLen)
+	binary.LittleEndian.PutUint32(buf[0:], saveMagic)
+	binary.LittleEndian.PutUint16(buf[4:], saveVersion)
+	buf[6], buf[7] = uint8(this.fpbits), uint8(this.bucketSize)
+	binary.LittleEndian.PutUint64(buf[8:], this.mask+1)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(this.count))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(this.victim))
+	binary.LittleEndian.PutUint64(buf[32:], this.victimFp)
+	binary.LittleEndian.PutUint32(buf[44:], crc32.ChecksumIEEE(buf[:44]))
+
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return BitMapCache.SaveCache(w, this.slots)
+}
+
+// read a filter written by Save
+func Load(r io.Reader) (*CuckooFilter, error) {
+	buf := make([]byte, saveHeadLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(buf[0:]) != saveMagic {
+		return nil, ErrFormat
+	}
+
+	if binary.LittleEndian.Uint16(buf[4:]) != saveVersion {
+		return nil, ErrVersion
+	}
+
+	if binary.LittleEndian.Uint32(buf[44:]) != crc32.ChecksumIEEE(buf[:44]) {
+		return nil, ErrChecksum
+	}
+
+	buckets := binary.LittleEndian.Uint64(buf[8:])
+	if buckets == 0 || buckets&(buckets-1) != 0 || buckets > 1<<40 || buf[6] > 32 || buf[7] == 0 {
+		return nil, ErrFormat
+	}
+
+	// the snapshot is checked before anything is allocated, the header can't
+	// make a huge filter alone
+	c, err := BitMapCache.LoadCache(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fpbits, bucketSize := int(buf[6]), int(buf[7])
+	slots, ok := c.(*BitMapCache.HistoryCache)
+	if !ok || slots.Bits() != fpbits || slots.Capacity() != int(buckets)*bucketSize {
+		return nil, ErrFormat
+	}
+
+	mask := buckets - 1
+	return &CuckooFilter{fpbits, bucketSize, mask, int(binary.LittleEndian.Uint64(buf[16:])),
+		int(binary.LittleEndian.Uint64(buf[24:]) & mask), binary.LittleEndian.Uint64(buf[32:]), slots}, nil
+}
@@ -0,0 +1,265 @@
+package HyperLogLog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/6xiao/go/BitMapCache"
+	"github.com/6xiao/go/Common"
+)
+
+/*
+approximate distinct counter, standard error 1.04/sqrt(2^precision).
+registers start sparse (a map of the registers != 0) and turn dense,
+6-bit registers in a BitMapCache.HistoryCache, when the map would be larger.
+
+binary layout, all fields little endian:
+
+	0  magic     uint32 "HLLG"
+	4  version   uint8
+	5  precision uint8
+	6  dense     uint8
+	7  -         uint8 reserved
+	8  sparse: n uint32, n * (register uint32, value uint8) sorted by register
+	   dense: a BitMapCache snapshot
+	.. crc       uint32 crc32(IEEE) of all bytes before
+*/
+
+const (
+	MinPrecision = 4
+	MaxPrecision = 18
+
+	registerBits = 6
+	hllMagic     = 0x474c4c48
+	hllVersion   = 1
+	hllHeadLen   = 8
+)
+
+var (
+	ErrPrecision = errors.New("hyperloglogs have different precision")
+	ErrFormat    = errors.New("bad hyperloglog data")
+	ErrChecksum  = errors.New("hyperloglog checksum mismatch")
+)
+
+type HyperLogLog struct {
+	precision uint
+	sparse    map[uint32]uint8
+	dense     *BitMapCache.HistoryCache
+}
+
+// precision is MinPrecision-MaxPrecision, nil if invalid
+func NewHyperLogLog(precision int) *HyperLogLog {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil
+	}
+	return &HyperLogLog{uint(precision), make(map[uint32]uint8), nil}
+}
+
+func (this *HyperLogLog) Precision() int {
+	return int(this.precision)
+}
+
+func (this *HyperLogLog) registers() int {
+	return 1 << this.precision
+}
+
+// a sparse entry costs about 8 times a dense register
+func (this *HyperLogLog) sparseLimit() int {
+	return this.registers() / 8
+}
+
+func (this *HyperLogLog) toDense() {
+	this.dense = BitMapCache.NewHistoryCache(registerBits, this.registers())
+	for index, value := range this.sparse {
+		this.dense.ResetIndex(int(index), uint64(value))
+	}
+	this.sparse = nil
+}
+
+func (this *HyperLogLog) set(index uint32, value uint8) {
+	if this.dense != nil {
+		if uint64(value) > this.dense.GetIndex(int(index)) {
+			this.dense.ResetIndex(int(index), uint64(value))
+		}
+		return
+	}
+
+	if value > this.sparse[index] {
+		this.sparse[index] = value
+		if len(this.sparse) > this.sparseLimit() {
+			this.toDense()
+		}
+	}
+}
+
+func (this *HyperLogLog) AddHash(hash uint64) {
+	index := uint32(hash >> (64 - this.precision))
+	rho := bits.LeadingZeros64(hash<<this.precision|1<<(this.precision-1)) + 1
+	this.set(index, uint8(rho))
+}
+
+// add data hashed by Common.Murmur3
+func (this *HyperLogLog) Add(data []byte) {
+	h1, _ := Common.Murmur3(data, 0)
+	this.AddHash(h1)
+}
+
+// the biggest register value AddHash sets
+func (this *HyperLogLog) maxRegister() uint64 {
+	return uint64(64 - this.precision + 1)
+}
+
+func (this *HyperLogLog) Estimate() uint64 {
+	m := float64(this.registers())
+	sum, zeros := 0.0, 0
+
+	if this.dense != nil {
+		for i := 0; i < this.registers(); i++ {
+			value := this.dense.GetIndex(i)
+			sum += math.Ldexp(1, -int(value))
+			if value == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = this.registers() - len(this.sparse)
+		sum = float64(zeros)
+		for _, value := range this.sparse {
+			sum += math.Ldexp(1, -int(value))
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	switch this.registers() {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// this counts the items of both
+func (this *HyperLogLog) Merge(other *HyperLogLog) error {
+	if this.precision != other.precision {
+		return ErrPrecision
+	}
+
+	if other.dense == nil {
+		for index, value := range other.sparse {
+			this.set(index, value)
+		}
+		return nil
+	}
+
+	if this.dense == nil {
+		this.toDense()
+	}
+
+	for i := other.dense.NextSet(0); i >= 0; i = other.dense.NextSet(i + 1) {
+		if value := other.dense.GetIndex(i); value > this.dense.GetIndex(i) {
+			this.dense.ResetIndex(i, value)
+		}
+	}
+	return nil
+}
+
+func (this *HyperLogLog) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	head := []byte{0, 0, 0, 0, hllVersion, uint8(this.precision), 0, 0}
+	binary.LittleEndian.PutUint32(head, hllMagic)
+
+	if this.dense != nil {
+		head[6] = 1
+		buf.Write(head)
+		if err := BitMapCache.SaveCache(buf, this.dense); err != nil {
+			return nil, err
+		}
+	} else {
+		buf.Write(head)
+
+		indexes := make([]int, 0, len(this.sparse))
+		for index := range this.sparse {
+			indexes = append(indexes, int(index))
+		}
+		sort.Ints(indexes)
+
+		entry := make([]byte, 5)
+		binary.LittleEndian.PutUint32(entry, uint32(len(indexes)))
+		buf.Write(entry[:4])
+		for _, index := range indexes {
+			binary.LittleEndian.PutUint32(entry, uint32(index))
+			entry[4] = this.sparse[uint32(index)]
+			buf.Write(entry)
+		}
+	}
+
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum)
+	return buf.Bytes(), nil
+}
+
+func (this *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < hllHeadLen+4 || binary.LittleEndian.Uint32(data) != hllMagic || data[4] != hllVersion {
+		return ErrFormat
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return ErrChecksum
+	}
+
+	res := NewHyperLogLog(int(data[5]))
+	if res == nil {
+		return ErrFormat
+	}
+
+	body = body[hllHeadLen:]
+	if data[6] != 0 {
+		res.toDense()
+		if err := BitMapCache.ReadSnapshot(bytes.NewReader(body), res.dense); err != nil {
+			return err
+		}
+
+		for i := res.dense.NextSet(0); i >= 0; i = res.dense.NextSet(i + 1) {
+			if res.dense.GetIndex(i) > res.maxRegister() {
+				return ErrFormat
+			}
+		}
+	} else {
+		if len(body) < 4 {
+			return ErrFormat
+		}
+
+		n := int(binary.LittleEndian.Uint32(body))
+		if n > res.registers() || len(body) != 4+5*n {
+			return ErrFormat
+		}
+
+		for i := 0; i < n; i++ {
+			entry := body[4+5*i:]
+			index := binary.LittleEndian.Uint32(entry)
+			if int(index) >= res.registers() || entry[4] == 0 || uint64(entry[4]) > res.maxRegister() {
+				return ErrFormat
+			}
+			res.set(index, entry[4])
+		}
+	}
+
+	*this = *res
+	return nil
+}
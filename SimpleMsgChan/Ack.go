@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/6xiao/go/Common"
+	"github.com/6xiao/go/SimpleMsgChan/protocol"
+)
+
+var (
+	flgRedeliver    = flag.Duration("redeliver", 5*time.Second, "send unacked reliable messages again after")
+	flgRedeliveries = flag.Int("redeliveries", 10, "times an unacked reliable message is sent again before it's dropped, 0 for no limit")
+)
+
+type pending struct {
+	frame    []byte
+	deadline time.Time
+	tries    int
+}
+
+// reliable messages of a receiver sent and not acked yet. a frame is sent to every
+// connection of the receiver and the ack of any of them clears it for all
+type Pending struct {
+	lock    sync.Mutex
+	seq     uint64
+	frames  map[uint64]*pending
+	running bool // a redeliver goroutine is running
+}
+
+// seqs start at the time in nanoseconds, they keep growing across restarts
+func NewPending() *Pending {
+	return &Pending{sync.Mutex{}, uint64(time.Now().UnixNano()), make(map[uint64]*pending), false}
+}
+
+// give a reliable frame the next seq
+func (p *Pending) Stamp(frame []byte) {
+	p.lock.Lock()
+	p.seq++
+	protocol.SetSeq(frame, p.seq)
+	p.lock.Unlock()
+}
+
+// a reliable frame was sent, true if a redeliver goroutine must be started
+func (p *Pending) Sent(frame []byte, seq uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.frames[seq] = &pending{frame, time.Now().Add(*flgRedeliver), 0}
+	start := !p.running
+	p.running = true
+	return start
+}
+
+func (p *Pending) Ack(seq uint64) {
+	p.lock.Lock()
+	delete(p.frames, seq)
+	p.lock.Unlock()
+}
+
+// frames to send again and seqs of the frames dropped: expired or sent too many times;
+// false when nothing is pending and the redeliver goroutine must quit
+func (p *Pending) Expired(online bool) ([][]byte, []uint64, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now, tm := time.Now(), Common.NumberTime(time.Now())
+	var frames [][]byte
+	var dropped []uint64
+	for seq, pd := range p.frames {
+		hd, err := protocol.DecodeHead(pd.frame)
+		kept := err == nil && (hd.KeepTime == 0 || hd.KeepTime > tm)
+		if !kept && (!online || err != nil || !hd.Realtime()) {
+			// realtime frames are tried while the receiver is online
+			delete(p.frames, seq)
+			dropped = append(dropped, seq)
+			continue
+		}
+
+		if !online || !now.After(pd.deadline) {
+			continue
+		}
+
+		if *flgRedeliveries > 0 && pd.tries >= *flgRedeliveries {
+			log.Println("reliable message", seq, "dropped, not acked after", pd.tries+1, "sends")
+			delete(p.frames, seq)
+			dropped = append(dropped, seq)
+			continue
+		}
+
+		pd.tries++
+		pd.deadline = now.Add(*flgRedeliver)
+		frames = append(frames, pd.frame)
+	}
+
+	p.running = len(p.frames) > 0
+	return frames, dropped, p.running
+}
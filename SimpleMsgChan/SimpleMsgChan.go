@@ -4,53 +4,60 @@ import (
 	"container/list"
 	"flag"
 	"github.com/6xiao/go/Common"
+	"github.com/6xiao/go/SimpleMsgChan/protocol"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 )
 
 var (
-	flgAddr = flag.String("addr", "127.0.0.1:5381", "message channel server addr")
+	flgAddr     = flag.String("addr", "127.0.0.1:5381", "message channel server addr")
+	flgMaxFrame = flag.Int("maxframe", protocol.MaxFrame, "max frame size in bytes")
 )
 
-const (
-	HeadLen    = 8
-	MsgHeadLen = 40
-)
-
-type MessageHead struct {
-	msglen   uint64
-	sender   uint64
-	recver   uint64
-	sendTime uint64
-	keepTime uint64
+// keep time of a frame read by protocol.ReadFrame
+func keepTime(msg []byte) uint64 {
+	if hd, err := protocol.DecodeHead(msg); err == nil {
+		return hd.KeepTime
+	}
+	return 0
 }
 
 //connect ...
 type Connect struct {
 	socket     net.Conn
 	dataChan   chan []byte
+	quit       chan bool
+	once       sync.Once
 	remoteAddr string
+	names      map[uint64]bool // observers joined, used by Recver only
+	modern     int32           // 1 once a frame newer than version 0 was read, atomic
 }
 
 func NewConnect(socket net.Conn) *Connect {
-	return &Connect{socket, make(chan []byte), ""}
+	return &Connect{socket, make(chan []byte), make(chan bool), sync.Once{},
+		socket.RemoteAddr().String(), make(map[uint64]bool), 0}
 }
 
 func (c *Connect) Addr() string {
 	return c.remoteAddr
 }
 
+// Send may be called after Close from other goroutines, so dataChan is never closed
 func (c *Connect) Close() {
-	close(c.dataChan)
+	c.once.Do(func() { close(c.quit) })
 }
 
 func (c *Connect) Send(msg []byte) {
 	if msg != nil {
-		c.dataChan <- msg
+		select {
+		case c.dataChan <- msg:
+		case <-c.quit:
+		}
 	}
 }
 
@@ -58,9 +65,19 @@ func (c *Connect) Sender() {
 	defer Common.CheckPanic()
 	defer c.socket.Close()
 
-	for buf := range c.dataChan {
-		if _, err := c.socket.Write(buf); err != nil {
-			log.Println(c.Addr(), "Socket Send Error ", err)
+	for {
+		select {
+		case buf := <-c.dataChan:
+			// a legacy client can't read the flags and seq of newer frames
+			if atomic.LoadInt32(&c.modern) == 0 {
+				buf = protocol.Downgrade(buf)
+			}
+
+			if _, err := c.socket.Write(buf); err != nil {
+				log.Println(c.Addr(), "Socket Send Error ", err)
+			}
+		case <-c.quit:
+			return
 		}
 	}
 }
@@ -70,76 +87,179 @@ func (c *Connect) Recver(in *Intranet) {
 	defer c.Close()
 	defer in.DelCon(c)
 
-	c.remoteAddr = c.socket.RemoteAddr().String()
-
 	for {
-		nethead := [HeadLen]byte{}
-		if _, e := io.ReadFull(c.socket, nethead[:]); e != nil {
+		msgbuf, hd, e := protocol.ReadFrame(c.socket, *flgMaxFrame)
+		if e != nil {
+			if e != io.EOF {
+				log.Println(c.Addr(), "read frame error", e)
+			}
 			break
 		}
 
-		msglen := *(*uint64)(unsafe.Pointer(&nethead))
-		if msglen < MsgHeadLen {
-			log.Println(c.Addr(), "msg head too short")
-			break
+		if hd.Version > 0 && atomic.LoadInt32(&c.modern) == 0 {
+			atomic.StoreInt32(&c.modern, 1)
 		}
 
-		msgbuf := make([]byte, HeadLen+msglen)
-
-		if _, e := io.ReadFull(c.socket, msgbuf[HeadLen:]); e != nil {
-			log.Println(c.Addr(), "msg body too short", e)
-			break
+		if hd.Flags&protocol.FlagAck != 0 {
+			// only a connection of the receiver may ack its messages
+			if c.names[hd.Recver] {
+				in.Ack(hd.Recver, hd.Seq)
+			} else {
+				log.Println(c.Addr(), "ack of", hd.Recver, "not subscribed, ignored")
+			}
+			continue
 		}
 
-		hd := (*MessageHead)(unsafe.Pointer(&msgbuf[0]))
-		hd.msglen = msglen
-
-		if hd.sender != 0 {
-			in.AddCon(hd.sender, c)
+		if hd.Sender != 0 {
+			in.AddCon(hd.Sender, c)
 		}
 
-		if hd.recver != 0 {
-			in.Publish(hd.recver, msgbuf, hd.sendTime == hd.keepTime)
+		if hd.Recver != 0 {
+			in.Publish(hd.Recver, msgbuf, hd.Realtime())
 		}
 	}
 }
 
+// offline messages of a receiver, logged under root if it's not empty;
+// reliable frames stay in the log until they are acked
 type SafeList struct {
-	lock sync.Mutex
-	lst  *list.List
+	lock    sync.Mutex
+	lst     *list.List
+	root    string
+	name    uint64
+	wal     *Wal              // open while lst or unacked isn't empty
+	unacked map[uint64][]byte // reliable frames sent and kept in the log
+	bytes   int64             // bytes of the frames in lst and unacked
 }
 
 func NewSafeList() *SafeList {
-	return &SafeList{sync.Mutex{}, list.New()}
+	return &SafeList{sync.Mutex{}, list.New(), "", 0, nil, make(map[uint64][]byte), 0}
+}
+
+// open the log on the first frame, false if it's disabled or can't be opened
+func (sl *SafeList) openWal() bool {
+	if sl.root != "" && sl.wal == nil {
+		w, err := OpenWal(sl.root, sl.name)
+		if err != nil {
+			log.Println("wal open error", err)
+			return false
+		}
+		sl.wal = w
+	}
+	return sl.wal != nil
+}
+
+func (sl *SafeList) append(msg []byte) {
+	if err := sl.wal.Append(msg); err != nil {
+		log.Println("wal append error", err)
+	}
 }
 
 func (sl *SafeList) Push(msg []byte) {
 	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
 	sl.lst.PushBack(msg)
-	sl.lock.Unlock()
+	sl.bytes += int64(len(msg))
+	if sl.openWal() {
+		sl.append(msg)
+	}
 }
 
-func (sl *SafeList) Pop() []byte {
+// a reliable frame sent without being buffered, logged until Done
+func (sl *SafeList) Sent(msg []byte, seq uint64) {
 	sl.lock.Lock()
-	f := sl.lst.Front()
-	if f == nil {
-		sl.lock.Unlock()
-		return nil
+	defer sl.lock.Unlock()
+
+	if sl.openWal() {
+		sl.append(msg)
+		sl.unacked[seq] = msg
+		sl.bytes += int64(len(msg))
 	}
+}
 
-	sl.lst.Remove(f)
-	sl.lock.Unlock()
+// a reliable frame was acked or dropped, the log may forget it
+func (sl *SafeList) Done(seq uint64) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
 
-	if msg, ok := f.Value.([]byte); ok {
-		hd := (*MessageHead)(unsafe.Pointer(&msg[0]))
-		if hd.keepTime == 0 || hd.keepTime > Common.NumberTime(time.Now()) {
-			return msg
+	if msg, ok := sl.unacked[seq]; ok {
+		delete(sl.unacked, seq)
+		sl.bytes -= int64(len(msg))
+		sl.syncWal(false)
+	}
+}
+
+// unacked frames in seq order, then the buffered ones
+func (sl *SafeList) frames() [][]byte {
+	seqs := make([]uint64, 0, len(sl.unacked))
+	for seq := range sl.unacked {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	frames := make([][]byte, 0, len(seqs)+sl.lst.Len())
+	for _, seq := range seqs {
+		frames = append(frames, sl.unacked[seq])
+	}
+	for e := sl.lst.Front(); e != nil; e = e.Next() {
+		frames = append(frames, e.Value.([]byte))
+	}
+	return frames
+}
+
+// drop the log if nothing is left in it, compact it if it's mostly sent frames
+func (sl *SafeList) syncWal(force bool) {
+	if sl.wal == nil {
+		return
+	}
+
+	if sl.lst.Len() == 0 && len(sl.unacked) == 0 {
+		if err := sl.wal.Drop(); err != nil {
+			log.Println("wal drop error", err)
+			sl.wal.Close()
+		}
+		sl.wal = nil
+		return
+	}
+
+	if force || sl.wal.Total() > 2*sl.bytes+*flgSegment {
+		if err := sl.wal.Compact(sl.frames()); err != nil {
+			log.Println("wal compact error", err)
 		}
 	}
+}
+
+// the first frame not expired, a reliable one stays in the log until Done
+func (sl *SafeList) Pop() []byte {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	for f := sl.lst.Front(); f != nil; f = sl.lst.Front() {
+		msg := sl.lst.Remove(f).([]byte)
+		hd, err := protocol.DecodeHead(msg)
+		if err != nil || (hd.KeepTime != 0 && hd.KeepTime <= Common.NumberTime(time.Now())) {
+			sl.bytes -= int64(len(msg))
+			continue
+		}
+
+		if sl.root != "" && hd.Flags&protocol.FlagReliable != 0 {
+			sl.unacked[hd.Seq] = msg
+		} else {
+			sl.bytes -= int64(len(msg))
+		}
+
+		sl.syncWal(false)
+		return msg
+	}
+
+	sl.syncWal(false)
 	return nil
 }
 
 func (sl *SafeList) Len() int {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
 	return sl.lst.Len()
 }
 
@@ -150,45 +270,115 @@ func (sl *SafeList) OutTimeClear() {
 	defer sl.lock.Unlock()
 
 	tm := Common.NumberTime(time.Now())
-	for e := sl.lst.Front(); e != nil; e = e.Next() {
+	for e := sl.lst.Front(); e != nil; {
+		next := e.Next()
 		if msg, ok := e.Value.([]byte); ok {
-			hd := (*MessageHead)(unsafe.Pointer(&msg[0]))
-			if hd.keepTime != 0 && hd.keepTime < tm {
-				e = e.Prev()
-				sl.lst.Remove(e.Next())
+			if kt := keepTime(msg); kt != 0 && kt < tm {
+				sl.lst.Remove(e)
+				sl.bytes -= int64(len(msg))
 			}
 		}
+		e = next
 	}
+
+	sl.syncWal(true)
 }
 
 type Observer struct {
 	name uint64
+	lock sync.RWMutex // guards set
 	set  map[string]*Connect
 	list *SafeList
+	acks *Pending
 }
 
 func NewObserver(name uint64) *Observer {
-	return &Observer{name, make(map[string]*Connect), NewSafeList()}
+	o := &Observer{name, sync.RWMutex{}, make(map[string]*Connect), NewSafeList(), NewPending()}
+	if *flgWal != "" {
+		replayObserverWal(*flgWal, name, o.list)
+	}
+	return o
+}
+
+// a copy of the connections, sending may block so it's done without the lock
+func (o *Observer) conns() []*Connect {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	cs := make([]*Connect, 0, len(o.set))
+	for _, c := range o.set {
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+func (o *Observer) online() bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return len(o.set) > 0
 }
 
 func (o *Observer) SendBuffer() {
 	defer Common.CheckPanic()
 
-	for len(o.set) > 0 && o.list.Len() > 0 {
+	for o.online() && o.list.Len() > 0 {
 		if msg := o.list.Pop(); msg != nil {
-			for _, v := range o.set {
+			o.send(o.conns(), msg, true)
+		}
+	}
+}
+
+// send to every connection, a reliable frame waits for an ack;
+// a buffered one waits even if the connections are gone meanwhile
+func (o *Observer) send(conns []*Connect, msg []byte, buffered bool) {
+	hd, err := protocol.DecodeHead(msg)
+	if err == nil && hd.Flags&protocol.FlagReliable != 0 && (buffered || len(conns) > 0) {
+		if !buffered {
+			o.list.Sent(msg, hd.Seq)
+		}
+
+		if o.acks.Sent(msg, hd.Seq) {
+			go o.Redeliver()
+		}
+	}
+
+	for _, v := range conns {
+		v.Send(msg)
+	}
+}
+
+// send unacked reliable frames again until nothing is pending
+func (o *Observer) Redeliver() {
+	defer Common.CheckPanic()
+
+	for {
+		time.Sleep(*flgRedeliver / 2)
+
+		conns := o.conns()
+		frames, dropped, more := o.acks.Expired(len(conns) > 0)
+		for _, msg := range frames {
+			for _, v := range conns {
 				v.Send(msg)
 			}
 		}
+
+		for _, seq := range dropped {
+			o.list.Done(seq)
+		}
+
+		if !more {
+			return
+		}
 	}
 }
 
 func (o *Observer) Add(c *Connect) {
+	o.lock.Lock()
 	empty := (len(o.set) == 0)
-
 	if _, ok := o.set[c.Addr()]; !ok {
 		o.set[c.Addr()] = c
 	}
+	o.lock.Unlock()
 
 	if empty {
 		go o.SendBuffer()
@@ -196,53 +386,107 @@ func (o *Observer) Add(c *Connect) {
 }
 
 func (o *Observer) Publish(msg []byte, realtime bool) {
-	if realtime || len(o.set) > 0 {
-		for _, v := range o.set {
-			v.Send(msg)
-		}
-	} else {
-		o.list.Push(msg)
-		l := o.list.Len()
-		if (l & (l - 1)) == 0 {
-			go o.list.OutTimeClear()
-		}
+	if hd, err := protocol.DecodeHead(msg); err == nil && hd.Flags&protocol.FlagReliable != 0 {
+		o.acks.Stamp(msg)
+	}
+
+	if conns := o.conns(); realtime || len(conns) > 0 {
+		o.send(conns, msg, false)
+		return
+	}
+
+	o.list.Push(msg)
+	l := o.list.Len()
+	if (l & (l - 1)) == 0 {
+		go o.list.OutTimeClear()
+	}
+
+	// a connection added meanwhile may have found the list empty
+	if o.online() {
+		go o.SendBuffer()
 	}
 }
 
 func (o *Observer) Delete(c *Connect) {
+	o.lock.Lock()
 	delete(o.set, c.Addr())
+	o.lock.Unlock()
 }
 
-type Intranet struct {
+// observers are sharded by name, so connections of different names rarely share a lock
+const shardCount = 64
+
+type shard struct {
+	lock   sync.RWMutex
 	tunnel map[uint64]*Observer
 }
 
+type Intranet struct {
+	shards [shardCount]shard
+}
+
 func NewIntranet() *Intranet {
-	return &Intranet{make(map[uint64]*Observer)}
+	ni := &Intranet{}
+	for i := range ni.shards {
+		ni.shards[i].tunnel = make(map[uint64]*Observer)
+	}
+	return ni
+}
+
+// nil if name has no observer
+func (ni *Intranet) find(name uint64) *Observer {
+	sh := &ni.shards[name%shardCount]
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.tunnel[name]
 }
 
+// the observer of name, created if missing
+func (ni *Intranet) Observer(name uint64) *Observer {
+	if o := ni.find(name); o != nil {
+		return o
+	}
+
+	// the log is replayed without the lock, an observer added meanwhile wins
+	o := NewObserver(name)
+
+	sh := &ni.shards[name%shardCount]
+	sh.lock.Lock()
+	if old, ok := sh.tunnel[name]; ok {
+		sh.lock.Unlock()
+		return old
+	}
+	sh.tunnel[name] = o
+	sh.lock.Unlock()
+
+	o.list.resume()
+	return o
+}
+
+// called by the Recver of c only
 func (ni *Intranet) DelCon(c *Connect) {
-	for _, obs := range ni.tunnel {
-		obs.Delete(c)
+	for name := range c.names {
+		if o := ni.find(name); o != nil {
+			o.Delete(c)
+		}
 	}
 }
 
+// called by the Recver of c only
 func (ni *Intranet) AddCon(name uint64, c *Connect) {
-	if o, ok := ni.tunnel[name]; ok {
-		o.Add(c)
-	} else {
-		no := NewObserver(name)
-		no.Add(c)
-		ni.tunnel[name] = no
-	}
+	c.names[name] = true
+	ni.Observer(name).Add(c)
 }
 
 func (ni *Intranet) Publish(recver uint64, msg []byte, realtime bool) {
-	if o, ok := ni.tunnel[recver]; ok {
-		o.Publish(msg, realtime)
-	} else {
-		ni.tunnel[recver] = NewObserver(recver)
-		ni.tunnel[recver].Publish(msg, realtime)
+	ni.Observer(recver).Publish(msg, realtime)
+}
+
+// an ack from any connection of recver clears the frame for all of them
+func (ni *Intranet) Ack(recver, seq uint64) {
+	if o := ni.find(recver); o != nil {
+		o.acks.Ack(seq)
+		o.list.Done(seq)
 	}
 }
 
@@ -255,7 +499,23 @@ func (ni *Intranet) Reactiver(c net.Conn) {
 func main() {
 	Common.Init(nil)
 
+	if *flgMaxFrame < protocol.HeadLen {
+		log.Fatalln("maxframe must be at least", protocol.HeadLen)
+	}
+
 	ni := NewIntranet()
+	if *flgWal != "" {
+		names, err := walNames(*flgWal)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		// offline messages logged before the restart
+		for _, name := range names {
+			ni.Observer(name)
+		}
+	}
+
 	err := Common.ListenSocket(*flgAddr, true, ni.Reactiver)
 	log.Println(err)
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/6xiao/go/Common"
+	"github.com/6xiao/go/SimpleMsgChan/client"
+	"github.com/6xiao/go/SimpleMsgChan/protocol"
+)
+
+// every member subscribes its own name and a group name, sends msgs messages to the
+// next member and groupMsgs messages to its group, half of them reliable; churn clients
+// connect, subscribe, publish and close meanwhile. a member must get every message
+// sent to it once, run with -race to find data races
+const (
+	members   = 300
+	msgs      = 50
+	groups    = 10
+	groupMsgs = 5
+	churners  = 50
+	timeout   = time.Minute
+
+	memberBase = 1 << 32
+	groupBase  = 2 << 32
+	churnBase  = 3 << 32
+)
+
+// redeliver soon, the flag is read by goroutines of every server so it's set
+// before any is started
+func TestMain(m *testing.M) {
+	flag.Parse()
+	*flgRedeliver = 200 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// an Intranet on a free port of 127.0.0.1
+func listen(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ni := NewIntranet()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ni.Reactiver(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+type member struct {
+	cli      *client.Client
+	name     uint64
+	group    uint64
+	expected int
+	lock     sync.Mutex
+	received map[string]int // payload: times received
+	count    int
+}
+
+func payload(sender, recver uint64, i int) string {
+	return fmt.Sprint(sender, "/", recver, "/", i)
+}
+
+func (m *member) receive(done *sync.WaitGroup) {
+	defer Common.CheckPanic()
+
+	for msg := range m.cli.Messages() {
+		m.cli.Ack(msg)
+
+		m.lock.Lock()
+		m.received[string(msg.Payload)]++
+		if m.count++; m.count == m.expected {
+			done.Done()
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *member) publish(t *testing.T, next uint64, failed *int64) {
+	defer Common.CheckPanic()
+
+	send := func(recver uint64, i int) {
+		var err error
+		if p := []byte(payload(m.name, recver, i)); i%2 == 0 {
+			err = m.cli.Publish(recver, p, time.Time{})
+		} else {
+			err = m.cli.PublishReliable(recver, p, time.Time{})
+		}
+
+		if err != nil {
+			t.Logf("%d publish: %v", m.name, err)
+			atomic.AddInt64(failed, 1)
+		}
+	}
+
+	for i := 0; i < msgs; i++ {
+		send(next, i)
+	}
+
+	for i := 0; i < groupMsgs; i++ {
+		send(m.group, i)
+	}
+}
+
+// connect, subscribe, publish and close until quit
+func churn(addr string, quit chan bool) {
+	defer Common.CheckPanic()
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		cli, err := client.Dial(addr)
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go func() {
+			for msg := range cli.Messages() {
+				cli.Ack(msg)
+			}
+		}()
+
+		cli.Subscribe(churnBase + uint64(rand.Intn(churners+1)))
+		cli.Subscribe(groupBase + uint64(rand.Intn(groups)))
+		for i := 0; i < 10; i++ {
+			cli.PublishRealtime(churnBase+uint64(rand.Intn(churners+1)), []byte("churn"))
+		}
+
+		// stay a while, most churn clients are online while the members publish
+		time.Sleep(time.Duration(100+rand.Intn(200)) * time.Millisecond)
+		cli.Close()
+	}
+}
+
+func TestStress(t *testing.T) {
+	addr := listen(t)
+
+	ms := make([]*member, members)
+	for i := range ms {
+		ms[i] = &member{name: memberBase + uint64(i), group: groupBase + uint64(i%groups),
+			expected: msgs + groupMsgs*((members-i%groups+groups-1)/groups), received: make(map[string]int)}
+	}
+
+	var subscribed sync.WaitGroup
+	errs := make(chan error, members)
+	for _, m := range ms {
+		subscribed.Add(1)
+		go func(m *member) {
+			defer subscribed.Done()
+
+			cli, err := client.Dial(addr)
+			if err == nil {
+				m.cli = cli
+				err = cli.Subscribe(m.name)
+			}
+			if err == nil {
+				err = cli.Subscribe(m.group)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(m)
+	}
+	subscribed.Wait()
+
+	defer func() {
+		for _, m := range ms {
+			if m.cli != nil {
+				m.cli.Close()
+			}
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("subscribe: %v", err)
+	default:
+	}
+
+	// the server handles the names of a connection in order, wait for all of them
+	time.Sleep(500 * time.Millisecond)
+
+	quit := make(chan bool)
+	defer close(quit)
+	for i := 0; i < churners; i++ {
+		go churn(addr, quit)
+	}
+
+	var done sync.WaitGroup
+	failed := int64(0)
+	for i, m := range ms {
+		done.Add(1)
+		go m.receive(&done)
+		go m.publish(t, ms[(i+1)%members].name, &failed)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+	}
+
+	// late duplicates
+	time.Sleep(time.Second)
+
+	if failed := atomic.LoadInt64(&failed); failed > 0 {
+		t.Fatalf("%d publish errors", failed)
+	}
+
+	for i, m := range ms {
+		prev := ms[(i+members-1)%members].name
+		want := make(map[string]bool)
+		for j := 0; j < msgs; j++ {
+			want[payload(prev, m.name, j)] = true
+		}
+		for _, s := range ms {
+			for j := 0; s.group == m.group && j < groupMsgs; j++ {
+				want[payload(s.name, m.group, j)] = true
+			}
+		}
+
+		m.lock.Lock()
+		for p, n := range m.received {
+			if !want[p] || n > 1 {
+				m.lock.Unlock()
+				t.Fatalf("member %d: extra message %q received %d times", m.name, p, n)
+			}
+		}
+
+		if len(m.received) != len(want) {
+			missing := len(want) - len(m.received)
+			m.lock.Unlock()
+			t.Fatalf("member %d: %d messages missing of %d", m.name, missing, len(want))
+		}
+		m.lock.Unlock()
+	}
+}
+
+// a raw connection subscribed to name
+func dialRaw(t *testing.T, addr string, name uint64) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if _, err := c.Write(protocol.NewFrame(&protocol.Head{Sender: name}, nil)); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	return c
+}
+
+func readHead(c net.Conn, wait time.Duration) (*protocol.Head, error) {
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, hd, err := protocol.ReadFrame(c, protocol.MaxFrame)
+	return hd, err
+}
+
+func ack(t *testing.T, c net.Conn, recver, seq uint64) {
+	frame := protocol.NewFrame(&protocol.Head{Flags: protocol.FlagAck, Recver: recver, Seq: seq}, nil)
+	if _, err := c.Write(frame); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+}
+
+func TestForeignAck(t *testing.T) {
+	addr := listen(t)
+	recver, foreign, sender := dialRaw(t, addr, 7), dialRaw(t, addr, 8), dialRaw(t, addr, 9)
+	time.Sleep(100 * time.Millisecond)
+
+	frame := protocol.NewFrame(&protocol.Head{Flags: protocol.FlagReliable, Sender: 9, Recver: 7}, []byte("r"))
+	if _, err := sender.Write(frame); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	first, err := readHead(recver, 2*time.Second)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// the ack of a connection not subscribed to 7 changes nothing
+	ack(t, foreign, 7, first.Seq)
+	again, err := readHead(recver, 2*time.Second)
+	if err != nil || again.Seq != first.Seq {
+		t.Fatalf("not redelivered after a foreign ack: %v %v", again, err)
+	}
+
+	ack(t, recver, 7, first.Seq)
+	time.Sleep(300 * time.Millisecond)
+	for {
+		// copies sent before the ack
+		if _, err := readHead(recver, 50*time.Millisecond); err != nil {
+			break
+		}
+	}
+
+	if hd, err := readHead(recver, time.Second); err == nil {
+		t.Fatalf("redelivered after the ack: %v", hd)
+	}
+}
+
+// a client of version 0 gets frames of newer clients as version 0
+func TestLegacyReceiver(t *testing.T) {
+	addr := listen(t)
+
+	legacy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer legacy.Close()
+
+	// the legacy head: a plain length, sender, recver, sendTime, keepTime
+	hello := make([]byte, protocol.HeadLen)
+	binary.LittleEndian.PutUint64(hello, protocol.HeadLen-protocol.LenSize)
+	binary.LittleEndian.PutUint64(hello[8:], 7)
+	if _, err := legacy.Write(hello); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	cli, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cli.Close()
+
+	if err := cli.PublishReliable(7, []byte("old"), time.Time{}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	legacy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame := make([]byte, protocol.HeadLen+3)
+	if _, err := io.ReadFull(legacy, frame); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if length := binary.LittleEndian.Uint64(frame); length != protocol.HeadLen-protocol.LenSize+3 {
+		t.Fatalf("length field %x, want a version 0 length", length)
+	}
+
+	if string(frame[protocol.HeadLen:]) != "old" || binary.LittleEndian.Uint64(frame[16:]) != 7 {
+		t.Fatalf("frame %x", frame)
+	}
+}
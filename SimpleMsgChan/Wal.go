@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/6xiao/go/SimpleMsgChan/protocol"
+)
+
+// write-ahead log of the offline messages of a receiver: <wal>/<name in hex>/<seq in hex>.seg,
+// every record is a frame followed by its crc32, appended in order; a segment is
+// rotated when it's full. compaction writes the frames still buffered into a .base
+// segment renamed into place at once, a base supersedes every older segment, so a
+// crash before they are removed replays nothing twice. appends go on in the base.
+// frames sent since the last compaction are replayed after a crash, so delivery is at
+// least once. a log is opened by the first offline message and removed when they are all sent
+
+var (
+	flgWal     = flag.String("wal", "", "write-ahead log dir of offline messages, empty to disable")
+	flgSegment = flag.Int64("segment", 64<<20, "wal segment size in bytes")
+)
+
+const (
+	segExt  = ".seg"
+	baseExt = ".base"
+)
+
+var errRecord = errors.New("bad wal record")
+
+type segment struct {
+	seq  uint64
+	base bool
+}
+
+type Wal struct {
+	dir   string
+	seq   uint64
+	file  *os.File
+	size  int64 // bytes of the current segment
+	total int64 // bytes of the live segments
+}
+
+func walDir(root string, name uint64) string {
+	return filepath.Join(root, fmt.Sprintf("%016x", name))
+}
+
+// open the log of a receiver, appends go to a new segment; segments older
+// than the last base are removed
+func OpenWal(root string, name uint64) (*Wal, error) {
+	dir := walDir(root, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wal{dir: dir}
+	for i, seg := range segs {
+		if i < liveFrom(segs) {
+			os.Remove(w.path(seg))
+			continue
+		}
+
+		if info, err := os.Stat(w.path(seg)); err == nil {
+			w.total += info.Size()
+		}
+		w.seq = seg.seq + 1
+	}
+
+	file, err := w.open(segment{w.seq, false})
+	if err != nil {
+		return nil, err
+	}
+
+	w.file = file
+	return w, nil
+}
+
+// segments in order
+func segments(dir string) ([]segment, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]segment, 0, len(files))
+	for _, file := range files {
+		base, ext := filepath.Base(file), filepath.Ext(file)
+		if ext != segExt && ext != baseExt {
+			continue
+		}
+
+		if seq, err := strconv.ParseUint(strings.TrimSuffix(base, ext), 16, 64); err == nil {
+			segs = append(segs, segment{seq, ext == baseExt})
+		}
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	return segs, nil
+}
+
+// index of the last base, segments before it are superseded
+func liveFrom(segs []segment) int {
+	for i := len(segs) - 1; i >= 0; i-- {
+		if segs[i].base {
+			return i
+		}
+	}
+	return 0
+}
+
+func (w *Wal) path(seg segment) string {
+	ext := segExt
+	if seg.base {
+		ext = baseExt
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%016x%s", seg.seq, ext))
+}
+
+func (w *Wal) open(seg segment) (*os.File, error) {
+	return os.OpenFile(w.path(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// bytes of the live segments, compaction shrinks them to the buffered frames
+func (w *Wal) Total() int64 {
+	return w.total
+}
+
+func record(frame []byte) []byte {
+	return binary.LittleEndian.AppendUint32(append([]byte(nil), frame...), crc32.ChecksumIEEE(frame))
+}
+
+// append a frame and sync it to disk
+func (w *Wal) Append(frame []byte) error {
+	if w.size > 0 && w.size+int64(len(frame))+4 > *flgSegment {
+		// the current segment takes the record if the next one can't be created
+		if file, err := w.open(segment{w.seq + 1, false}); err != nil {
+			log.Println("wal rotate error", err)
+		} else {
+			w.file.Close()
+			w.file, w.seq, w.size = file, w.seq+1, 0
+		}
+	}
+
+	n, err := w.file.Write(record(frame))
+	w.size += int64(n)
+	w.total += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// keep only frames: write them to a new base and remove the older segments,
+// the log is unchanged if an error is returned
+func (w *Wal) Compact(frames [][]byte) error {
+	base := segment{w.seq + 1, true}
+	tmp := w.path(base) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	size, wt := int64(0), bufio.NewWriter(file)
+	for _, frame := range frames {
+		n, _ := wt.Write(record(frame))
+		size += int64(n)
+	}
+
+	if err = wt.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, w.path(base))
+	}
+	if err == nil {
+		err = syncDir(w.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// the base is in place, older segments are never replayed again
+	file, err = w.open(base)
+	if err != nil {
+		return err
+	}
+
+	w.file.Close()
+	w.file, w.seq, w.size, w.total = file, base.seq, size, size
+
+	segs, _ := segments(w.dir)
+	for _, seg := range segs {
+		if seg.seq < base.seq {
+			os.Remove(w.path(seg))
+		}
+	}
+	return nil
+}
+
+// remove the log, an empty base is written first so a crash
+// while removing replays nothing
+func (w *Wal) Drop() error {
+	if err := w.Compact(nil); err != nil {
+		return err
+	}
+
+	w.file.Close()
+	if err := os.Remove(w.path(segment{w.seq, true})); err != nil {
+		return err
+	}
+	return os.Remove(w.dir)
+}
+
+func (w *Wal) Close() error {
+	return w.file.Close()
+}
+
+// call fn on every frame of the live segments in order, a torn or broken
+// tail of a segment (crash while appending) is skipped
+func ReplayWal(dir string, fn func(frame []byte)) error {
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+
+	w := &Wal{dir: dir}
+	for _, seg := range segs[liveFrom(segs):] {
+		file, err := os.Open(w.path(seg))
+		if err != nil {
+			return err
+		}
+
+		rd := bufio.NewReader(file)
+		for {
+			frame, err := readRecord(rd)
+			if err != nil {
+				if err != io.EOF {
+					log.Println(w.path(seg), err)
+				}
+				break
+			}
+			fn(frame)
+		}
+		file.Close()
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	frame, _, err := protocol.ReadFrame(r, *flgMaxFrame)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(sum) != crc32.ChecksumIEEE(frame) {
+		return nil, errRecord
+	}
+	return frame, nil
+}
+
+// the frames of a receiver logged before, nothing is written: observers of a name
+// may be created at once and only one is kept, it calls resume
+func replayObserverWal(root string, name uint64, sl *SafeList) {
+	sl.root, sl.name = root, name
+
+	dir := walDir(root, name)
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+
+	err := ReplayWal(dir, func(frame []byte) {
+		sl.lst.PushBack(frame)
+		sl.bytes += int64(len(frame))
+	})
+	if err != nil {
+		log.Println("replay wal", dir, err)
+	}
+}
+
+// open the log replayed, expired frames are compacted out
+func (sl *SafeList) resume() {
+	if sl.root == "" {
+		return
+	}
+
+	if _, err := os.Stat(walDir(sl.root, sl.name)); err != nil {
+		return
+	}
+
+	sl.lock.Lock()
+	sl.openWal()
+	sl.lock.Unlock()
+
+	sl.OutTimeClear()
+}
+
+// names of the receivers with a log
+func walNames(root string) ([]uint64, error) {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make([]uint64, 0, len(dirs))
+	for _, dir := range dirs {
+		if name, err := strconv.ParseUint(dir.Name(), 16, 64); err == nil && dir.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/6xiao/go/Common"
+	"github.com/6xiao/go/SimpleMsgChan/protocol"
+)
+
+// client of the SimpleMsgChan server, frames are described in package protocol.
+// a client receives the messages sent to every name it subscribed,
+// the names are announced again after a reconnect.
+// a reliable message is sent again by the server until it's acked by Ack, it's
+// delivered once: redelivered copies are dropped by their seq, and acked again
+// if it was acked before
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+	dedupSize  = 4096 // seqs remembered per recver
+)
+
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrNotConnected = errors.New("not connected, reconnecting")
+	ErrMsgSize      = errors.New("message too large")
+)
+
+type Message struct {
+	Sender   uint64
+	Recver   uint64
+	SendTime uint64
+	KeepTime uint64
+	Seq      uint64 // set by the server on reliable messages
+	Payload  []byte
+	flags    uint8
+}
+
+// the last seqs seen of a recver, true once acked
+type window struct {
+	seen map[uint64]bool
+	ring []uint64
+	next int
+}
+
+func newWindow() *window {
+	return &window{make(map[uint64]bool), make([]uint64, dedupSize), 0}
+}
+
+// false if seq was seen before
+func (this *window) add(seq uint64) bool {
+	if _, ok := this.seen[seq]; ok {
+		return false
+	}
+
+	delete(this.seen, this.ring[this.next])
+	this.ring[this.next] = seq
+	this.next = (this.next + 1) % len(this.ring)
+	this.seen[seq] = false
+	return true
+}
+
+type Client struct {
+	addr  string
+	lock  sync.Mutex // guards conn and names, serializes writes
+	conn  net.Conn
+	names []uint64
+	msgs  chan *Message
+	quit  chan bool
+	once  sync.Once
+	dlock sync.Mutex // guards dedup
+	dedup map[uint64]*window
+	acks  chan *Message
+}
+
+// connect to the server, the client reconnects by itself once connected
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &Client{addr: addr, conn: conn, msgs: make(chan *Message, 1024),
+		quit: make(chan bool), dedup: make(map[uint64]*window), acks: make(chan *Message, 1024)}
+	go this.run(conn)
+	go this.ack()
+	return this, nil
+}
+
+// received messages, closed after Close
+func (this *Client) Messages() <-chan *Message {
+	return this.msgs
+}
+
+func (this *Client) Close() error {
+	this.once.Do(func() { close(this.quit) })
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.conn != nil {
+		return this.conn.Close()
+	}
+	return nil
+}
+
+func (this *Client) closed() bool {
+	select {
+	case <-this.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func encode(msg *Message) []byte {
+	head := &protocol.Head{Flags: msg.flags, Sender: msg.Sender, Recver: msg.Recver,
+		SendTime: msg.SendTime, KeepTime: msg.KeepTime, Seq: msg.Seq}
+	return protocol.NewFrame(head, msg.Payload)
+}
+
+func decode(r io.Reader) (*Message, error) {
+	frame, head, err := protocol.ReadFrame(r, protocol.MaxFrame)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{head.Sender, head.Recver, head.SendTime, head.KeepTime, head.Seq,
+		frame[head.Size():], head.Flags}, nil
+}
+
+func (this *Client) write(msg *Message) error {
+	if len(msg.Payload) > protocol.MaxFrame-protocol.HeadLen-protocol.SeqLen {
+		return ErrMsgSize
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed() {
+		return ErrClosed
+	}
+
+	if this.conn == nil {
+		return ErrNotConnected
+	}
+
+	_, err := this.conn.Write(encode(msg))
+	return err
+}
+
+// receive the messages sent to name
+func (this *Client) Subscribe(name uint64) error {
+	this.lock.Lock()
+	exists := false
+	for _, n := range this.names {
+		exists = exists || n == name
+	}
+	if !exists {
+		this.names = append(this.names, name)
+	}
+	this.lock.Unlock()
+
+	return this.write(&Message{Sender: name})
+}
+
+// the first name subscribed, the sender of published messages
+func (this *Client) sender() uint64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.names) > 0 {
+		return this.names[0]
+	}
+	return 0
+}
+
+// send payload to recver, kept for it until keepUntil if it's offline,
+// a zero keepUntil keeps it forever, keepUntil now is realtime
+func (this *Client) Publish(recver uint64, payload []byte, keepUntil time.Time) error {
+	return this.write(&Message{Sender: this.sender(), Recver: recver, SendTime: Common.NumberNow(),
+		KeepTime: keepNumber(keepUntil), Payload: payload})
+}
+
+// like Publish, but the server sends it again until a receiver acks it
+func (this *Client) PublishReliable(recver uint64, payload []byte, keepUntil time.Time) error {
+	return this.write(&Message{Sender: this.sender(), Recver: recver, SendTime: Common.NumberNow(),
+		KeepTime: keepNumber(keepUntil), Payload: payload, flags: protocol.FlagReliable})
+}
+
+// send payload to recver, dropped if it's offline
+func (this *Client) PublishRealtime(recver uint64, payload []byte) error {
+	now := Common.NumberNow()
+	return this.write(&Message{Sender: this.sender(), Recver: recver, SendTime: now, KeepTime: now, Payload: payload})
+}
+
+func keepNumber(keepUntil time.Time) uint64 {
+	if keepUntil.IsZero() {
+		return 0
+	}
+	return Common.NumberTime(keepUntil.In(time.Local))
+}
+
+// the ack is written by the ack goroutine, neither run nor the reader of Messages
+// block on the server, which may be blocked on this client
+func (this *Client) queueAck(msg *Message) {
+	select {
+	case this.acks <- &Message{Recver: msg.Recver, Seq: msg.Seq, flags: protocol.FlagAck}:
+	default: // the message is sent again and acked then
+	}
+}
+
+// false if a reliable message was delivered before, acked again if Ack was called,
+// the ack of the earlier copy may be lost
+func (this *Client) accept(msg *Message) bool {
+	if msg.flags&protocol.FlagReliable == 0 {
+		return true
+	}
+
+	this.dlock.Lock()
+	defer this.dlock.Unlock()
+
+	w, ok := this.dedup[msg.Recver]
+	if !ok {
+		w = newWindow()
+		this.dedup[msg.Recver] = w
+	}
+
+	if w.add(msg.Seq) {
+		return true
+	}
+
+	if w.seen[msg.Seq] {
+		this.queueAck(msg)
+	}
+	return false
+}
+
+// a reliable message is handled, the server stops sending it;
+// nothing is done for other messages
+func (this *Client) Ack(msg *Message) {
+	if msg.flags&protocol.FlagReliable == 0 {
+		return
+	}
+
+	this.dlock.Lock()
+	if w, ok := this.dedup[msg.Recver]; ok {
+		if _, ok := w.seen[msg.Seq]; ok {
+			w.seen[msg.Seq] = true
+		}
+	}
+	this.dlock.Unlock()
+
+	this.queueAck(msg)
+}
+
+// write the acks of run
+func (this *Client) ack() {
+	defer Common.CheckPanic()
+
+	for {
+		select {
+		case msg := <-this.acks:
+			if err := this.write(msg); err != nil && err != ErrClosed {
+				log.Println(this.addr, "msg chan ack error", err)
+			}
+		case <-this.quit:
+			return
+		}
+	}
+}
+
+// read messages, reconnect with backoff when the connection breaks
+func (this *Client) run(conn net.Conn) {
+	defer Common.CheckPanic()
+	defer close(this.msgs)
+
+	for {
+		for {
+			msg, err := decode(conn)
+			if err != nil {
+				if !this.closed() {
+					log.Println(this.addr, "msg chan read error", err)
+				}
+				break
+			}
+
+			if !this.accept(msg) {
+				continue
+			}
+
+			select {
+			case this.msgs <- msg:
+			case <-this.quit:
+				conn.Close()
+				return
+			}
+		}
+
+		this.lock.Lock()
+		this.conn = nil
+		this.lock.Unlock()
+		conn.Close()
+
+		if conn = this.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// nil after Close
+func (this *Client) reconnect() net.Conn {
+	for backoff := minBackoff; ; {
+		select {
+		case <-this.quit:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := net.Dial("tcp", this.addr)
+		if err != nil {
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		// announce the names before anyone else writes
+		this.lock.Lock()
+		for _, name := range this.names {
+			if _, err = conn.Write(encode(&Message{Sender: name})); err != nil {
+				break
+			}
+		}
+
+		ok := err == nil && !this.closed()
+		if ok {
+			this.conn = conn
+		}
+		this.lock.Unlock()
+
+		if ok {
+			return conn
+		}
+		conn.Close()
+	}
+}
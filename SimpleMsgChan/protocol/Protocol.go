@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+frame format of SimpleMsgChan, all fields little endian:
+
+	0  length   uint64 bits 0-47: bytes after this field, 32 + len(payload),
+	                   8 more with FlagReliable or FlagAck
+	                   bits 48-55: flags
+	                   bits 56-63: protocol version
+	8  sender   uint64 name of the sending client, 0 for none
+	16 recver   uint64 name the message is sent to, 0 to only announce sender
+	24 sendTime uint64 Common.NumberTime
+	32 keepTime uint64 Common.NumberTime, kept for offline receivers until then,
+	                   0 keeps it forever, sendTime == keepTime never keeps it
+	40 seq      uint64 only with FlagReliable or FlagAck
+	.. payload
+
+version 0 is the legacy format written as a native uint64 length on
+little endian hosts, it has no flags and no seq. frames are forwarded unchanged,
+except the seq of reliable frames set by the server; a connection which has only
+sent version 0 frames gets every frame as version 0 (Downgrade), reliable ones
+included, it can't ack them.
+
+reliable delivery: the server sets a seq on a FlagReliable frame and sends it
+again until a receiver of recver answers with a FlagAck frame of that recver
+and seq, so a receiver may get it more than once and drops it by seq
+*/
+
+const (
+	LenSize  = 8
+	HeadLen  = 40
+	SeqLen   = 8
+	Version  = 1
+	MaxFrame = 64 << 20 // default biggest frame, length field included
+
+	lengthMask = 1<<48 - 1
+)
+
+const (
+	FlagReliable = 1 << iota // redelivered until acked
+	FlagAck                  // acknowledges the seq of recver, never forwarded
+)
+
+var (
+	ErrVersion   = errors.New("unknown protocol version")
+	ErrFrameSize = errors.New("frame too large")
+	ErrShortHead = errors.New("frame shorter than head")
+)
+
+type Head struct {
+	Version  uint8
+	Flags    uint8
+	Length   uint64 // bytes after the length field
+	Sender   uint64
+	Recver   uint64
+	SendTime uint64
+	KeepTime uint64
+	Seq      uint64
+}
+
+// never kept for offline receivers
+func (this *Head) Realtime() bool {
+	return this.SendTime == this.KeepTime
+}
+
+func (this *Head) HasSeq() bool {
+	return this.Flags&(FlagReliable|FlagAck) != 0
+}
+
+// bytes before the payload
+func (this *Head) Size() int {
+	if this.HasSeq() {
+		return HeadLen + SeqLen
+	}
+	return HeadLen
+}
+
+// payload bytes of the frame
+func (this *Head) PayloadLen() int {
+	return LenSize + int(this.Length) - this.Size()
+}
+
+// buf must have Size() bytes
+func (this *Head) Put(buf []byte) {
+	lenField := this.Length&lengthMask | uint64(this.Flags)<<48 | uint64(this.Version)<<56
+	binary.LittleEndian.PutUint64(buf[0:], lenField)
+	binary.LittleEndian.PutUint64(buf[8:], this.Sender)
+	binary.LittleEndian.PutUint64(buf[16:], this.Recver)
+	binary.LittleEndian.PutUint64(buf[24:], this.SendTime)
+	binary.LittleEndian.PutUint64(buf[32:], this.KeepTime)
+	if this.HasSeq() {
+		binary.LittleEndian.PutUint64(buf[40:], this.Seq)
+	}
+}
+
+// decode the head of a frame
+func DecodeHead(buf []byte) (*Head, error) {
+	if len(buf) < HeadLen {
+		return nil, ErrShortHead
+	}
+
+	lenField := binary.LittleEndian.Uint64(buf)
+	head := &Head{uint8(lenField >> 56), uint8(lenField >> 48), lenField & lengthMask,
+		binary.LittleEndian.Uint64(buf[8:]),
+		binary.LittleEndian.Uint64(buf[16:]),
+		binary.LittleEndian.Uint64(buf[24:]),
+		binary.LittleEndian.Uint64(buf[32:]), 0}
+
+	if head.Version > Version {
+		return nil, ErrVersion
+	}
+
+	// flags of the legacy version have no meaning
+	if head.Version == 0 {
+		head.Flags = 0
+	}
+
+	if LenSize+head.Length < uint64(head.Size()) || len(buf) < head.Size() {
+		return nil, ErrShortHead
+	}
+
+	if head.HasSeq() {
+		head.Seq = binary.LittleEndian.Uint64(buf[40:])
+	}
+	return head, nil
+}
+
+// a frame of the current version, head.Length and head.Version are set
+func NewFrame(head *Head, payload []byte) []byte {
+	head.Version = Version
+	head.Length = uint64(head.Size() - LenSize + len(payload))
+
+	buf := make([]byte, head.Size(), head.Size()+len(payload))
+	head.Put(buf)
+	return append(buf, payload...)
+}
+
+// the frame as version 0 for a legacy receiver, without flags and seq;
+// a frame of version 0 or a broken one is returned unchanged
+func Downgrade(frame []byte) []byte {
+	head, err := DecodeHead(frame)
+	if err != nil || head.Version == 0 || len(frame) < head.Size() {
+		return frame
+	}
+
+	payload := frame[head.Size():]
+	old := &Head{Sender: head.Sender, Recver: head.Recver, SendTime: head.SendTime, KeepTime: head.KeepTime,
+		Length: uint64(HeadLen - LenSize + len(payload))}
+
+	buf := make([]byte, HeadLen, HeadLen+len(payload))
+	old.Put(buf)
+	return append(buf, payload...)
+}
+
+// change the seq of a frame with FlagReliable or FlagAck
+func SetSeq(frame []byte, seq uint64) {
+	binary.LittleEndian.PutUint64(frame[HeadLen:], seq)
+}
+
+// read a whole frame, maxFrame limits its size before anything is allocated,
+// a maxFrame below HeadLen can't hold any frame
+func ReadFrame(r io.Reader, maxFrame int) ([]byte, *Head, error) {
+	if maxFrame < HeadLen {
+		return nil, nil, ErrFrameSize
+	}
+
+	buf := make([]byte, LenSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+
+	length := binary.LittleEndian.Uint64(buf) & lengthMask
+	if length > uint64(maxFrame-LenSize) {
+		return nil, nil, ErrFrameSize
+	}
+
+	if length < HeadLen-LenSize {
+		return nil, nil, ErrShortHead
+	}
+
+	frame := make([]byte, LenSize+length)
+	copy(frame, buf)
+	if _, err := io.ReadFull(r, frame[LenSize:]); err != nil {
+		return nil, nil, err
+	}
+
+	head, err := DecodeHead(frame)
+	if err != nil {
+		return nil, nil, err
+	}
+	return frame, head, nil
+}